@@ -0,0 +1,169 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	addressDelays = flag.Bool("address_delays", false,
+		"set the delay of each link in the event engine from the address "+
+			"types of its nodes, rather than link_delay")
+
+	clearnetDelay = flag.Duration("clearnet_delay", 50*time.Millisecond,
+		"minimum delay of links between nodes that can reach each other "+
+			"over clearnet")
+
+	clearnetJitter = flag.Duration("clearnet_jitter", 50*time.Millisecond,
+		"maximum delay added to clearnet links")
+
+	torClearnetDelay = flag.Duration("tor_clearnet_delay",
+		250*time.Millisecond,
+		"minimum delay of links between an onion-only node and a "+
+			"clearnet node, which run over a Tor exit circuit")
+
+	torClearnetJitter = flag.Duration("tor_clearnet_jitter",
+		250*time.Millisecond,
+		"maximum delay added to links between onion-only and clearnet "+
+			"nodes")
+
+	torDelay = flag.Duration("tor_delay", 500*time.Millisecond,
+		"minimum delay of links between onion-only nodes, which run over "+
+			"a Tor rendezvous circuit")
+
+	torJitter = flag.Duration("tor_jitter", 500*time.Millisecond,
+		"maximum delay added to links between onion-only nodes")
+)
+
+// AddressType describes the networks a node advertises addresses on.
+type AddressType int
+
+const (
+	// AddressUnknown is used for nodes that do not advertise any
+	// addresses. They are treated as clearnet nodes.
+	AddressUnknown AddressType = iota
+
+	// AddressClearnet is used for nodes that only advertise clearnet
+	// addresses.
+	AddressClearnet
+
+	// AddressOnion is used for nodes that only advertise onion addresses,
+	// so can only be reached over Tor.
+	AddressOnion
+
+	// AddressMixed is used for nodes that advertise both clearnet and
+	// onion addresses.
+	AddressMixed
+)
+
+func (a AddressType) String() string {
+	switch a {
+	case AddressUnknown:
+		return "unknown"
+
+	case AddressClearnet:
+		return "clearnet"
+
+	case AddressOnion:
+		return "onion"
+
+	case AddressMixed:
+		return "mixed"
+
+	default:
+		return fmt.Sprintf("address type %d", int(a))
+	}
+}
+
+// ClassifyAddresses returns the address type of a node from the addresses it
+// advertises, in host:port form.
+func ClassifyAddresses(addresses []string) AddressType {
+	var onion, clearnet bool
+	for _, addr := range addresses {
+		if strings.Contains(strings.ToLower(addr), ".onion") {
+			onion = true
+		} else {
+			clearnet = true
+		}
+	}
+
+	switch {
+	case onion && clearnet:
+		return AddressMixed
+
+	case onion:
+		return AddressOnion
+
+	case clearnet:
+		return AddressClearnet
+
+	default:
+		return AddressUnknown
+	}
+}
+
+// AddressDelays holds the delay distributions of links between nodes with
+// different address types. Nodes that can be reached over clearnet are
+// connected over clearnet, and links to onion-only nodes run over Tor.
+type AddressDelays struct {
+	// Clearnet is used for links between nodes that are not onion-only.
+	Clearnet DelayDistribution
+
+	// TorClearnet is used for links between an onion-only node and a node
+	// that can be reached over clearnet.
+	TorClearnet DelayDistribution
+
+	// Tor is used for links between onion-only nodes.
+	Tor DelayDistribution
+}
+
+// addressDelayConfig returns the address delays set by flags. Each link's
+// delay is uniformly distributed between its minimum and the minimum plus
+// its jitter.
+func addressDelayConfig() *AddressDelays {
+	return &AddressDelays{
+		Clearnet: &uniformDelay{
+			min: *clearnetDelay,
+			max: *clearnetDelay + *clearnetJitter,
+		},
+		TorClearnet: &uniformDelay{
+			min: *torClearnetDelay,
+			max: *torClearnetDelay + *torClearnetJitter,
+		},
+		Tor: &uniformDelay{
+			min: *torDelay,
+			max: *torDelay + *torJitter,
+		},
+	}
+}
+
+// between returns the delay distribution of a link between nodes with the
+// address types provided.
+func (a *AddressDelays) between(x, y AddressType) DelayDistribution {
+	switch {
+	case x == AddressOnion && y == AddressOnion:
+		return a.Tor
+
+	case x == AddressOnion || y == AddressOnion:
+		return a.TorClearnet
+
+	default:
+		return a.Clearnet
+	}
+}
+
+// Apply sets the delay of every link in the graph from the address types of
+// its nodes.
+func (a *AddressDelays) Apply(delays *LinkDelays, nodes map[string]Node,
+	graph *GraphChannels) {
+
+	for pubkey, node := range nodes {
+		for _, peer := range node.GetPeers() {
+			delays.SetLink(pubkey, peer, a.between(
+				graph.AddressType(pubkey), graph.AddressType(peer),
+			))
+		}
+	}
+}
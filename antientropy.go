@@ -0,0 +1,226 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+)
+
+// digestEntrySize is the wire size of each entry in the digest that peers
+// exchange to compare the messages they have, which is a short channel ID and
+// a timestamp as in a query_channel_range reply.
+const digestEntrySize = 8 + 4
+
+// NewAntiEntropy returns an anti-entropy process which fully syncs pairs of
+// peers every interval ticks, running at most maxRounds rounds once relaying
+// has settled.
+func NewAntiEntropy(interval, pairs, maxRounds int, seed int64) *AntiEntropy {
+	return &AntiEntropy{
+		Interval:  interval,
+		Pairs:     pairs,
+		MaxRounds: maxRounds,
+		rand:      rand.New(rand.NewSource(seed)),
+	}
+}
+
+// AntiEntropy is a background process which repairs gaps left by a relay
+// protocol. Every Interval ticks it picks Pairs random pairs of peers, which
+// compare the messages they have and send each other the ones the other is
+// missing (or only has an older version of). Repaired messages are delivered
+// with ReceiveMessage, so it works with any Node type, and nodes treat them
+// like any other message they receive from a peer.
+type AntiEntropy struct {
+	// Interval is the number of ticks between anti-entropy rounds.
+	Interval int
+
+	// Pairs is the number of peer pairs that are synced in each round.
+	Pairs int
+
+	// MaxRounds is the number of rounds that are run once relaying has
+	// settled if every node is not in sync with its peers first. Zero runs
+	// rounds until they are.
+	MaxRounds int
+
+	// settledRounds is the number of rounds run since relaying settled,
+	// and clean is set once one of them repairs nothing and finds every
+	// node in sync with its peers.
+	settledRounds int
+	clean         bool
+
+	rand *rand.Rand
+}
+
+// repairResult summarizes the work done in an anti-entropy round.
+type repairResult struct {
+	// pairs is the number of peer pairs that were synced.
+	pairs int
+
+	// digestEntries is the number of message IDs and timestamps that peers
+	// exchanged to compare the messages they have.
+	digestEntries int
+
+	// repaired is the number of messages that were sent to fill gaps.
+	repaired int
+
+	// bytes is the number of bytes sent in digests and repairs.
+	bytes int
+}
+
+// Run performs an anti-entropy round if one is due at tick, recording the
+// bytes that each node sends and receives in usage. Settled reports whether
+// relaying had settled before the round, so that rounds that follow it are
+// counted towards Done.
+func (a *AntiEntropy) Run(dbc *labelledDB, nodes map[string]Node,
+	tick int, settled bool, usage bandwidthUsage) (*repairResult, error) {
+
+	// start counting again if repairs or new messages got relaying going
+	if !settled {
+		a.settledRounds = 0
+		a.clean = false
+	}
+
+	result := &repairResult{}
+	if a.Interval <= 0 || tick%a.Interval != 0 {
+		return result, nil
+	}
+
+	if settled {
+		defer func() {
+			a.settledRounds++
+			a.clean = result.repaired == 0 && inSync(nodes)
+		}()
+	}
+
+	// sort nodes so that the same seed always picks the same pairs
+	var candidates []string
+	for pubkey, node := range nodes {
+		if len(node.GetPeers()) > 0 {
+			candidates = append(candidates, pubkey)
+		}
+	}
+	sort.Strings(candidates)
+
+	if len(candidates) == 0 {
+		return result, nil
+	}
+
+	for i := 0; i < a.Pairs; i++ {
+		node := nodes[candidates[a.rand.Intn(len(candidates))]]
+
+		peers := node.GetPeers()
+		peer, ok := nodes[peers[a.rand.Intn(len(peers))]]
+		if !ok {
+			continue
+		}
+
+		err := syncPair(dbc, node, peer, tick, result, usage)
+		if err != nil {
+			return nil, err
+		}
+		result.pairs++
+	}
+
+	return result, nil
+}
+
+// Done returns true if anti-entropy has no more rounds to run once relaying
+// has settled, because a round repaired nothing and every node was in sync
+// with its peers, or MaxRounds rounds have run. It is nil-safe, and returns true when anti-entropy is off.
+func (a *AntiEntropy) Done() bool {
+	if a == nil || a.Interval <= 0 {
+		return true
+	}
+
+	return a.clean || (a.MaxRounds > 0 && a.settledRounds >= a.MaxRounds)
+}
+
+// inSync returns true if every node has all of the messages that its peers
+// have. The random pairs of a round may all be in sync while other nodes are
+// still missing messages, so a round that repairs nothing does not show that
+// there is nothing left to repair.
+func inSync(nodes map[string]Node) bool {
+	messages := make(map[string][]Message, len(nodes))
+	for pubkey, node := range nodes {
+		messages[pubkey] = node.GetMessages()
+	}
+
+	for pubkey, node := range nodes {
+		for _, peer := range node.GetPeers() {
+			peerMessages, ok := messages[peer]
+			if !ok {
+				continue
+			}
+
+			missing := missingMessages(peerMessages, messages[pubkey])
+			if len(missing) > 0 {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// syncPair exchanges the messages that each node of a pair is missing.
+func syncPair(dbc *labelledDB, a, b Node, tick int, result *repairResult,
+	usage bandwidthUsage) error {
+
+	send := func(from, to Node, bytes int) {
+		usage.get(from.GetPubkey()).sent += bytes
+		usage.get(to.GetPubkey()).received += bytes
+		result.bytes += bytes
+	}
+
+	// each side sends the other a digest of the messages it has
+	aMessages, bMessages := a.GetMessages(), b.GetMessages()
+	result.digestEntries += len(aMessages) + len(bMessages)
+	send(a, b, len(aMessages)*digestEntrySize)
+	send(b, a, len(bMessages)*digestEntrySize)
+
+	// work out what each side is missing before delivering anything, so
+	// that we only send what the nodes had at the start of the sync
+	toB := missingMessages(aMessages, bMessages)
+	toA := missingMessages(bMessages, aMessages)
+
+	for _, msg := range toB {
+		send(a, b, msg.Size())
+		if err := b.ReceiveMessage(dbc, msg, tick, a.GetPubkey()); err != nil {
+			return err
+		}
+	}
+
+	for _, msg := range toA {
+		send(b, a, msg.Size())
+		if err := a.ReceiveMessage(dbc, msg, tick, b.GetPubkey()); err != nil {
+			return err
+		}
+	}
+
+	result.repaired += len(toA) + len(toB)
+
+	return nil
+}
+
+// missingMessages returns the messages in have that are not in other, or that
+// other only has an older version of, sorted by ID.
+func missingMessages(have, other []Message) []Message {
+	otherByID := make(map[string]Message, len(other))
+	for _, msg := range other {
+		otherByID[msg.ID()] = msg
+	}
+
+	var missing []Message
+	for _, msg := range have {
+		existing, ok := otherByID[msg.ID()]
+		if ok && !existing.TimeStamp().Before(msg.TimeStamp()) {
+			continue
+		}
+
+		missing = append(missing, msg)
+	}
+
+	sort.Slice(missing, func(i, j int) bool {
+		return missing[i].ID() < missing[j].ID()
+	})
+
+	return missing
+}
@@ -0,0 +1,729 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+var (
+	churnFile = flag.String("churn_file", "",
+		"path to a CSV file of node_id,offline_tick,online_tick rows "+
+			"listing the outages of nodes that go offline")
+
+	churnShare = flag.Float64("churn_share", 0,
+		"share of nodes, picked at random, that go offline and come "+
+			"back online during the simulation (0 disables churn "+
+			"unless churn_file is set)")
+
+	churnUptime = flag.Duration("churn_uptime", 30*time.Minute,
+		"mean time that churning nodes stay online for")
+
+	churnDowntime = flag.Duration("churn_downtime", 15*time.Minute,
+		"mean time that churning nodes stay offline for")
+
+	churnSync = flag.String("churn_sync", "query",
+		"how nodes catch up when they come back online: query sends a "+
+			"query_channel_range to a peer and filter sends each peer "+
+			"a gossip_timestamp_filter from the newest message the "+
+			"node had when it went offline")
+)
+
+// dropReasonOffline is recorded for messages sent to or originated by a node
+// while it is offline.
+const dropReasonOffline = "offline"
+
+// Outage is a period in which a node is offline. The node goes offline at the
+// start of tick Start and comes back online at the start of tick End.
+type Outage struct {
+	Start int
+	End   int
+}
+
+// UptimeSchedule decides when nodes go offline and come back online. Ticks
+// are counted in the engine's ticks, which are steps in the event engine.
+type UptimeSchedule interface {
+	// Nodes returns the pubkeys of the nodes that may go offline.
+	Nodes() []string
+
+	// NextOutage returns the first outage of a node that starts at or
+	// after tick, and false if the node does not go offline again.
+	NextOutage(pubkey string, tick int) (Outage, bool)
+}
+
+// fileSchedule is an uptime schedule which lists the outages of each node.
+type fileSchedule map[string][]Outage
+
+// ReadUptimeSchedule reads a schedule from CSV rows of node_id, offline_tick
+// and online_tick. A node may have any number of outages, which must not
+// overlap.
+func ReadUptimeSchedule(r io.Reader) (UptimeSchedule, error) {
+	return readFileSchedule(r)
+}
+
+func readFileSchedule(r io.Reader) (fileSchedule, error) {
+	rows, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	schedule := make(fileSchedule)
+	for i, row := range rows {
+		// skip the header row
+		if i == 0 && len(row) > 0 && row[0] == "node_id" {
+			continue
+		}
+
+		if len(row) != 3 {
+			return nil, fmt.Errorf("row %v: expected 3 columns, got %v",
+				i+1, len(row))
+		}
+
+		start, err := strconv.Atoi(row[1])
+		if err != nil {
+			return nil, fmt.Errorf("row %v: offline_tick: %v", i+1, err)
+		}
+
+		end, err := strconv.Atoi(row[2])
+		if err != nil {
+			return nil, fmt.Errorf("row %v: online_tick: %v", i+1, err)
+		}
+
+		if start < 0 || end <= start {
+			return nil, fmt.Errorf("row %v: online tick %v must be "+
+				"after offline tick %v", i+1, end, start)
+		}
+
+		schedule[row[0]] = append(schedule[row[0]], Outage{
+			Start: start,
+			End:   end,
+		})
+	}
+
+	for pubkey, outages := range schedule {
+		sort.Slice(outages, func(i, j int) bool {
+			return outages[i].Start < outages[j].Start
+		})
+
+		for i := 1; i < len(outages); i++ {
+			if outages[i].Start < outages[i-1].End {
+				return nil, fmt.Errorf("outages of %v overlap at "+
+					"tick %v", pubkey, outages[i].Start)
+			}
+		}
+	}
+
+	return schedule, nil
+}
+
+// scale returns the schedule with its ticks, which each represent from,
+// converted to ticks that each represent to. Outages are rounded up to
+// whole ticks, and last at least one tick.
+func (f fileSchedule) scale(from, to time.Duration) fileSchedule {
+	convert := func(tick int) int {
+		return int(math.Ceil(float64(time.Duration(tick)*from) /
+			float64(to)))
+	}
+
+	scaled := make(fileSchedule, len(f))
+	for pubkey, outages := range f {
+		for _, outage := range outages {
+			start, end := convert(outage.Start), convert(outage.End)
+			if end <= start {
+				end = start + 1
+			}
+
+			scaled[pubkey] = append(scaled[pubkey], Outage{
+				Start: start,
+				End:   end,
+			})
+		}
+	}
+
+	return scaled
+}
+
+func (f fileSchedule) Nodes() []string {
+	pubkeys := make([]string, 0, len(f))
+	for pubkey := range f {
+		pubkeys = append(pubkeys, pubkey)
+	}
+	sort.Strings(pubkeys)
+
+	return pubkeys
+}
+
+func (f fileSchedule) NextOutage(pubkey string, tick int) (Outage, bool) {
+	for _, outage := range f[pubkey] {
+		if outage.Start >= tick {
+			return outage, true
+		}
+	}
+
+	return Outage{}, false
+}
+
+// NewChurnModel returns a schedule in which a share of nodes, picked at
+// random, go offline and come back online for exponentially distributed
+// numbers of ticks with the means provided.
+func NewChurnModel(pubkeys []string, share, uptime, downtime float64,
+	seed int64) *ChurnModel {
+
+	sorted := append([]string(nil), pubkeys...)
+	sort.Strings(sorted)
+
+	r := rand.New(rand.NewSource(seed))
+	r.Shuffle(len(sorted), func(i, j int) {
+		sorted[i], sorted[j] = sorted[j], sorted[i]
+	})
+
+	churning := sorted[:int(math.Round(share*float64(len(sorted))))]
+	sort.Strings(churning)
+
+	model := &ChurnModel{
+		Uptime:   uptime,
+		Downtime: downtime,
+		pubkeys:  churning,
+		rand:     make(map[string]*rand.Rand, len(churning)),
+	}
+	for _, pubkey := range churning {
+		model.rand[pubkey] = nodeRand(seed, pubkey)
+	}
+
+	return model
+}
+
+// ChurnModel is an uptime schedule in which nodes alternate between being
+// online and offline for random periods. Each node's periods are drawn from
+// its own source of randomness, so they do not depend on when the schedule is
+// asked for them.
+type ChurnModel struct {
+	// Uptime is the mean number of ticks that nodes stay online for.
+	Uptime float64
+
+	// Downtime is the mean number of ticks that nodes stay offline for.
+	Downtime float64
+
+	pubkeys []string
+	rand    map[string]*rand.Rand
+}
+
+func (c *ChurnModel) Nodes() []string {
+	return c.pubkeys
+}
+
+// NextOutage draws the time until the node next goes offline, and how long
+// it stays offline for.
+func (c *ChurnModel) NextOutage(pubkey string, tick int) (Outage, bool) {
+	r, ok := c.rand[pubkey]
+	if !ok {
+		return Outage{}, false
+	}
+
+	start := tick + sampleTicks(r, c.Uptime)
+
+	return Outage{
+		Start: start,
+		End:   start + sampleTicks(r, c.Downtime),
+	}, true
+}
+
+// sampleTicks returns an exponentially distributed number of ticks with the
+// mean provided, which is at least one.
+func sampleTicks(r *rand.Rand, mean float64) int {
+	ticks := int(math.Round(r.ExpFloat64() * mean))
+	if ticks < 1 {
+		return 1
+	}
+
+	return ticks
+}
+
+// ReconnectSync sets how nodes catch up on the messages they missed when they
+// come back online.
+type ReconnectSync int
+
+const (
+	// SyncQuery has the node send a query_channel_range to its first
+	// online peer, and request the messages it is missing.
+	SyncQuery ReconnectSync = iota
+
+	// SyncFilter has the node send a gossip_timestamp_filter to each of
+	// its online peers, starting at the newest message it had when it
+	// went offline. Peers send it the messages they have inside the
+	// filter.
+	SyncFilter
+)
+
+func (s ReconnectSync) String() string {
+	switch s {
+	case SyncQuery:
+		return "query"
+
+	case SyncFilter:
+		return "filter"
+
+	default:
+		return fmt.Sprintf("reconnect sync %d", int(s))
+	}
+}
+
+// ParseReconnectSync parses a reconnect sync flag.
+func ParseReconnectSync(sync string) (ReconnectSync, error) {
+	switch sync {
+	case "query":
+		return SyncQuery, nil
+
+	case "filter":
+		return SyncFilter, nil
+
+	default:
+		return 0, fmt.Errorf("unknown reconnect sync: %v", sync)
+	}
+}
+
+// Disconnectable is implemented by nodes that keep state about the exchanges
+// they are running with each peer, which is lost when the connection to the
+// peer drops.
+type Disconnectable interface {
+	// PeerDisconnected is called when the connection to a peer drops,
+	// because either side went offline. The node must give up on any
+	// exchange in progress with the peer, and not start new ones with it
+	// until PeerConnected is called.
+	PeerDisconnected(peer string)
+
+	// PeerConnected is called when the connection to a peer is restored.
+	PeerConnected(peer string)
+}
+
+// NewChurn returns a churn process which takes nodes offline and brings them
+// back online following a schedule.
+func NewChurn(schedule UptimeSchedule, sync ReconnectSync) *Churn {
+	c := &Churn{
+		Schedule:    schedule,
+		Sync:        sync,
+		pubkeys:     schedule.Nodes(),
+		next:        make(map[string]Outage),
+		offline:     make(map[string]offlineNode),
+		reconnected: make(map[string]bool),
+	}
+
+	for _, pubkey := range c.pubkeys {
+		if outage, ok := schedule.NextOutage(pubkey, 0); ok {
+			c.next[pubkey] = outage
+		}
+	}
+
+	return c
+}
+
+// Churn takes nodes offline and brings them back online during a
+// simulation. An offline node does not receive, originate or relay messages,
+// and the messages sent to it are dropped. When it comes back online it runs
+// a reconnect sync with its peers to catch up on what it missed. Once the
+// network has settled, with no more messages to simulate or relay, nodes no
+// longer go offline, so the simulation runs until the offline nodes have come
+// back and caught up.
+type Churn struct {
+	// Schedule decides when nodes go offline and come back online.
+	Schedule UptimeSchedule
+
+	// Sync is the way nodes catch up when they come back online. Nodes
+	// that do not support it use the other way if they can.
+	Sync ReconnectSync
+
+	// pubkeys are the nodes that may go offline, in sorted order.
+	pubkeys []string
+
+	// next holds the current or next outage of each node.
+	next map[string]Outage
+
+	// offline holds the nodes that are offline.
+	offline map[string]offlineNode
+
+	// reconnected holds the nodes that came back online this tick.
+	reconnected map[string]bool
+}
+
+// offlineNode records when a node went offline and the newest message that
+// it had at that point.
+type offlineNode struct {
+	tick   int
+	newest time.Time
+}
+
+// churnResult summarizes the nodes that went offline and came back online in
+// a tick.
+type churnResult struct {
+	// offline is the number of nodes that went offline.
+	offline int
+
+	// online is the number of nodes that came back online.
+	online int
+
+	// stale is the number of messages that nodes coming back online were
+	// missing, or only had an older version of, compared to their peers.
+	stale int
+
+	// unsynced is the number of nodes that came back online but could not
+	// run a reconnect sync.
+	unsynced int
+
+	// dropped is the number of gossip messages that were not delivered
+	// because the node they were sent to or originated by was offline.
+	dropped int
+}
+
+// Update takes nodes offline and brings them back online at the start of a
+// tick. Nodes do not go offline once the network has settled.
+func (c *Churn) Update(dbc *labelledDB, nodes map[string]Node, tick int,
+	settled bool) (*churnResult, error) {
+
+	result := &churnResult{}
+	c.reconnected = make(map[string]bool)
+
+	for _, pubkey := range c.pubkeys {
+		node, ok := nodes[pubkey]
+		if !ok {
+			continue
+		}
+
+		outage, ok := c.next[pubkey]
+		if !ok {
+			continue
+		}
+
+		if offline, ok := c.offline[pubkey]; ok {
+			if tick < outage.End {
+				continue
+			}
+
+			delete(c.offline, pubkey)
+			c.reconnected[pubkey] = true
+			result.online++
+
+			c.setConnected(nodes, node, true)
+
+			stale := c.staleness(nodes, node)
+			result.stale += stale
+
+			err := WriteOutage(dbc, pubkey, offline.tick, tick, stale)
+			if err != nil {
+				return nil, err
+			}
+
+			if !c.reconnect(nodes, node, offline.newest) {
+				result.unsynced++
+			}
+
+			next, ok := c.Schedule.NextOutage(pubkey, tick)
+			if !ok {
+				delete(c.next, pubkey)
+				continue
+			}
+			c.next[pubkey] = next
+
+			continue
+		}
+
+		if tick < outage.Start {
+			continue
+		}
+
+		if settled {
+			delete(c.next, pubkey)
+			continue
+		}
+
+		c.offline[pubkey] = offlineNode{
+			tick:   tick,
+			newest: newestMessage(node),
+		}
+		result.offline++
+
+		c.setConnected(nodes, node, false)
+	}
+
+	return result, nil
+}
+
+// setConnected tells a node and its online peers that the connections
+// between them have dropped or been restored.
+func (c *Churn) setConnected(nodes map[string]Node, node Node,
+	connected bool) {
+
+	notify := func(n Node, peer string) {
+		d, ok := n.(Disconnectable)
+		if !ok {
+			return
+		}
+
+		if connected {
+			d.PeerConnected(peer)
+		} else {
+			d.PeerDisconnected(peer)
+		}
+	}
+
+	for _, peer := range node.GetPeers() {
+		peerNode, ok := nodes[peer]
+		if !ok || c.Offline(peer) {
+			continue
+		}
+
+		notify(node, peer)
+		notify(peerNode, node.GetPubkey())
+	}
+}
+
+// Offline returns true if a node is offline.
+func (c *Churn) Offline(pubkey string) bool {
+	if c == nil {
+		return false
+	}
+
+	_, ok := c.offline[pubkey]
+	return ok
+}
+
+// Waiting returns true if any nodes are offline, so the simulation should not
+// end until they have come back online.
+func (c *Churn) Waiting() bool {
+	return c != nil && len(c.offline) > 0
+}
+
+// Online returns the nodes that are online.
+func (c *Churn) Online(nodes map[string]Node) map[string]Node {
+	if c == nil || len(c.offline) == 0 {
+		return nodes
+	}
+
+	online := make(map[string]Node, len(nodes))
+	for pubkey, node := range nodes {
+		if !c.Offline(pubkey) {
+			online[pubkey] = node
+		}
+	}
+
+	return online
+}
+
+// Active returns the pubkeys provided that are online, keeping their order.
+// Nodes that came back online this tick are left out if reconnected is not
+// set, since the queues they had when they went offline are stale.
+func (c *Churn) Active(pubkeys []string, reconnected bool) []string {
+	if c == nil || len(c.offline)+len(c.reconnected) == 0 {
+		return pubkeys
+	}
+
+	active := make([]string, 0, len(pubkeys))
+	for _, pubkey := range pubkeys {
+		if c.Offline(pubkey) {
+			continue
+		}
+
+		if !reconnected && c.reconnected[pubkey] {
+			continue
+		}
+
+		active = append(active, pubkey)
+	}
+
+	return active
+}
+
+// NextChange returns the next tick at which a node goes offline or comes
+// back online, and false if no more nodes will.
+func (c *Churn) NextChange() (int, bool) {
+	if c == nil {
+		return 0, false
+	}
+
+	var (
+		next  int
+		found bool
+	)
+	for _, pubkey := range c.pubkeys {
+		outage, ok := c.next[pubkey]
+		if !ok {
+			continue
+		}
+
+		change := outage.Start
+		if c.Offline(pubkey) {
+			change = outage.End
+		}
+
+		if !found || change < next {
+			next = change
+			found = true
+		}
+	}
+
+	return next, found
+}
+
+// Drop records the gossip messages that an offline node misses, and returns
+// the number of them that were recorded. Messages that protocols use to relay
+// gossip are lost without being recorded or counted.
+func (c *Churn) Drop(dbc *labelledDB, pubkey string, messages []Message,
+	tick int) (int, error) {
+
+	var dropped int
+	for _, msg := range messages {
+		if !isGossip(msg) {
+			continue
+		}
+
+		err := ReportDropped(dbc, msg, pubkey, tick, dropReasonOffline)
+		if err != nil {
+			return 0, err
+		}
+		dropped++
+	}
+
+	return dropped, nil
+}
+
+// reconnect has a node that came back online start a sync with its online
+// peers, and returns false if the node supports neither way of syncing.
+func (c *Churn) reconnect(nodes map[string]Node, node Node,
+	since time.Time) bool {
+
+	var peers []string
+	for _, peer := range node.GetPeers() {
+		if _, ok := nodes[peer]; ok && !c.Offline(peer) {
+			peers = append(peers, peer)
+		}
+	}
+
+	querier, canQuery := node.(Querier)
+	filterer, canFilter := node.(TimestampFilterer)
+
+	sync := c.Sync
+	switch {
+	case sync == SyncQuery && !canQuery:
+		sync = SyncFilter
+
+	case sync == SyncFilter && !canFilter:
+		sync = SyncQuery
+	}
+
+	switch {
+	case sync == SyncQuery && canQuery:
+		if len(peers) > 0 {
+			querier.QueryPeer(peers[0])
+		}
+
+	case sync == SyncFilter && canFilter:
+		for _, peer := range peers {
+			filterer.SendTimestampFilter(peer, sinceFilter(since))
+		}
+
+	default:
+		log.Printf("Node %v cannot sync with its peers after coming "+
+			"back online", node.GetPubkey())
+		return false
+	}
+
+	return true
+}
+
+// staleness returns the number of messages that a node's online peers have
+// which it is missing, or only has an older version of.
+func (c *Churn) staleness(nodes map[string]Node, node Node) int {
+	have := node.GetMessages()
+
+	stale := make(map[string]bool)
+	for _, peer := range node.GetPeers() {
+		peerNode, ok := nodes[peer]
+		if !ok || c.Offline(peer) {
+			continue
+		}
+
+		for _, msg := range missingMessages(peerNode.GetMessages(), have) {
+			stale[msg.ID()] = true
+		}
+	}
+
+	return len(stale)
+}
+
+// newestMessage returns the timestamp of the newest message a node has.
+func newestMessage(node Node) time.Time {
+	var newest time.Time
+	for _, msg := range node.GetMessages() {
+		if msg.TimeStamp().After(newest) {
+			newest = msg.TimeStamp()
+		}
+	}
+
+	return newest
+}
+
+// isGossip returns true if a message is a gossip message, rather than a
+// message that a protocol uses to relay gossip.
+func isGossip(msg Message) bool {
+	switch msg.(type) {
+	case *ChannelAnnouncement, *ChannelUpdate, *NodeAnnouncement:
+		return true
+
+	default:
+		return false
+	}
+}
+
+// newChurn returns the churn process set by flags for a set of nodes, or nil
+// if churn is disabled.
+func newChurn(nodes map[string]Node) (*Churn, error) {
+	sync, err := ParseReconnectSync(*churnSync)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case *churnFile != "":
+		file, err := os.Open(*churnFile)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		schedule, err := readFileSchedule(file)
+		if err != nil {
+			return nil, fmt.Errorf("could not read churn file: %v",
+				err)
+		}
+
+		// the file is counted in ticks of tick_seconds, which are
+		// steps in the event engine
+		schedule = schedule.scale(tickDuration(), stepDuration())
+
+		return NewChurn(schedule, sync), nil
+
+	case *churnShare > 0:
+		if *churnShare > 1 || *churnUptime <= 0 || *churnDowntime <= 0 {
+			return nil, fmt.Errorf("churn share must be at most 1 "+
+				"and uptime and downtime must be positive, got: "+
+				"%v, %v, %v", *churnShare, *churnUptime,
+				*churnDowntime)
+		}
+
+		model := NewChurnModel(sortedPubkeys(nodes), *churnShare,
+			float64(*churnUptime)/float64(stepDuration()),
+			float64(*churnDowntime)/float64(stepDuration()), *seed)
+
+		return NewChurn(model, sync), nil
+
+	default:
+		return nil, nil
+	}
+}
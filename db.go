@@ -31,6 +31,22 @@ func getSocketFile() string {
 type labelledDB struct {
 	dbc   *sql.DB
 	label string
+
+	// writes buffers the messages seen and dropped instead of writing them
+	// to the DB, they are written when the buffer is flushed. Writes are
+	// made directly if it is nil.
+	writes *writeBuffer
+}
+
+// buffered returns a copy of the DB which buffers the messages seen and
+// dropped, so that they can be recorded concurrently and written in a fixed
+// order.
+func (db *labelledDB) buffered() *labelledDB {
+	return &labelledDB{
+		dbc:    db.dbc,
+		label:  db.label,
+		writes: newWriteBuffer(),
+	}
 }
 
 func Connect(label string) (*labelledDB, error) {
@@ -79,6 +95,19 @@ func connectWithURI(connectStr string) (*sql.DB, error) {
 // WriteMessageSeen logs the tick at which a message was seen by a node.
 // It may be called multiple times for a given node and message.
 func WriteMessageSeen(db *labelledDB, uuid int64, nodeID string, tick int) error {
+	if db.writes != nil {
+		db.writes.messageSeen(uuid, nodeID, tick)
+		return nil
+	}
+
+	return writeMessageSeen(db, uuid, nodeID, tick, tick, 1)
+}
+
+// writeMessageSeen logs that a node saw a message count times, first at the
+// first tick and last at the last tick provided.
+func writeMessageSeen(db *labelledDB, uuid int64, nodeID string, first, last,
+	count int) error {
+
 	var newRecord bool
 
 	var firstSeen, lastSeen, seenCount int
@@ -95,13 +124,13 @@ func WriteMessageSeen(db *labelledDB, uuid int64, nodeID string, tick int) error
 	// if we have seen the node has seen the message before, update the last
 	// seen and count.
 	query := fmt.Sprintf("update received_messages set last_seen=%v, "+
-		"seen_count=%v where uuid=%v and node_id=\"%v\" and label=\"%v\"", tick, seenCount+1,
+		"seen_count=%v where uuid=%v and node_id=\"%v\" and label=\"%v\"", last, seenCount+count,
 		uuid, nodeID, db.label)
 	// if this is the first time the message has been seen, create a new record.
 	if newRecord {
 		query = fmt.Sprintf("insert into received_messages "+
 			"(uuid, node_id, first_seen, last_seen, seen_count, label) "+
-			"values (%v,\"%v\",%v,%v,%v,\"%v\")", uuid, nodeID, tick, tick, 1, db.label)
+			"values (%v,\"%v\",%v,%v,%v,\"%v\")", uuid, nodeID, first, last, count, db.label)
 	}
 
 	res, err := db.dbc.Exec(query)
@@ -121,6 +150,107 @@ func WriteMessageSeen(db *labelledDB, uuid int64, nodeID string, tick int) error
 	return nil
 }
 
+// WriteMessageDropped logs that a node dropped a message it received at a
+// tick, along with the reason it was dropped.
+func WriteMessageDropped(db *labelledDB, uuid int64, nodeID string, tick int, reason string) error {
+	if db.writes != nil {
+		db.writes.messageDropped(uuid, nodeID, tick, reason)
+		return nil
+	}
+
+	_, err := db.dbc.Exec("insert into dropped_messages "+
+		"(uuid, node_id, tick, reason, label) values (?,?,?,?,?)",
+		uuid, nodeID, tick, reason, db.label)
+	return err
+}
+
+// GetDroppedCount returns the number of times a message was dropped by a node.
+func GetDroppedCount(db *labelledDB, messageID int64) (int, error) {
+	var total int
+
+	err := db.dbc.QueryRow("select count(*) from dropped_messages "+
+		"where uuid=? and label=?", messageID, db.label).Scan(&total)
+	if err != nil {
+		return 0, err
+	}
+
+	return total, nil
+}
+
+// WriteBandwidth logs the number of bytes a node sent to and received from its
+// peers in a tick.
+func WriteBandwidth(db *labelledDB, nodeID string, tick, sent, received int) error {
+	_, err := db.dbc.Exec("insert into bandwidth "+
+		"(node_id, tick, bytes_sent, bytes_received, label) "+
+		"values (?,?,?,?,?)", nodeID, tick, sent, received, db.label)
+	return err
+}
+
+// WriteRun records the seed and flags that a simulation was run with, so that
+// the run can be reproduced.
+func WriteRun(db *labelledDB, seed int64, config string) error {
+	_, err := db.dbc.Exec("insert into runs (label, seed, config) "+
+		"values (?,?,?)", db.label, seed, config)
+	return err
+}
+
+// WriteOutage records a period in which a node was offline, and the number of
+// messages that it was missing when it came back online.
+func WriteOutage(db *labelledDB, nodeID string, offline, online,
+	stale int) error {
+
+	_, err := db.dbc.Exec("insert into outages (node_id, offline_tick, "+
+		"online_tick, stale_messages, label) values (?,?,?,?,?)", nodeID,
+		offline, online, stale, db.label)
+	return err
+}
+
+// GetStaleness returns the number of times a node went offline, and the
+// total number of messages that it was missing when it came back online.
+func GetStaleness(db *labelledDB, nodeID string) (int, int, error) {
+	var outages, stale int
+
+	err := db.dbc.QueryRow("select count(*), coalesce(sum(stale_messages), "+
+		"0) from outages where node_id=? and label=?", nodeID,
+		db.label).Scan(&outages, &stale)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return outages, stale, nil
+}
+
+// GetRun returns the seed and flags that a simulation was run with.
+func GetRun(db *labelledDB) (int64, string, error) {
+	var (
+		seed   int64
+		config string
+	)
+
+	err := db.dbc.QueryRow("select seed, config from runs where label=?",
+		db.label).Scan(&seed, &config)
+	if err != nil {
+		return 0, "", err
+	}
+
+	return seed, config, nil
+}
+
+// GetBandwidth returns the total number of bytes a node sent and received
+// over the course of the simulation.
+func GetBandwidth(db *labelledDB, nodeID string) (int, int, error) {
+	var sent, received int
+
+	err := db.dbc.QueryRow("select coalesce(sum(bytes_sent), 0), "+
+		"coalesce(sum(bytes_received), 0) from bandwidth where node_id=? "+
+		"and label=?", nodeID, db.label).Scan(&sent, &received)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return sent, received, nil
+}
+
 var (
 	errUnexpectedFirstSeen = errors.New("first record of message earlier than expected")
 	errNegativeLatency     = errors.New("negative latency calculated")
@@ -231,11 +361,16 @@ type summary struct {
 	latency          int
 	duplicateBuckets map[int]int
 	averageLatency   float64
+	dropped          int
 }
 
-func (s *summary) print() {
-	log.Printf("Summary for message: %v, latency: %v, average ticks: %v",
-		s.messageID, s.latency, s.averageLatency)
+// print logs the summary, with latencies in ticks and in the time that they
+// represent when each tick is the duration provided.
+func (s *summary) print(tick time.Duration) {
+	log.Printf("Summary for message: %v, latency: %v ticks (%v), average "+
+		"latency: %v ticks (%v), dropped: %v", s.messageID, s.latency,
+		time.Duration(s.latency)*tick, s.averageLatency,
+		time.Duration(s.averageLatency*float64(tick)), s.dropped)
 
 	for k, v := range s.duplicateBuckets {
 		log.Printf("Nodes that received message more than %v times: %v", k, v)
@@ -246,7 +381,8 @@ func (s *summary) print() {
 // Return a summary for every message sent during the simulation. This includes
 // the latency for the message to propagate and the duplicate count.
 func GetSummary(db *labelledDB) ([]summary, error) {
-	rows, err := db.dbc.Query("select distinct uuid from received_messages")
+	rows, err := db.dbc.Query("select distinct uuid from received_messages " +
+		"order by uuid")
 	if err != nil {
 		return nil, err
 	}
@@ -273,10 +409,16 @@ func GetSummary(db *labelledDB) ([]summary, error) {
 			return nil, err
 		}
 
+		dropped, err := GetDroppedCount(db, uuid)
+		if err != nil {
+			return nil, err
+		}
+
 		summary := summary{
 			messageID:      uuid,
 			latency:        latency,
 			averageLatency: averageLatency,
+			dropped:        dropped,
 		}
 
 		buckets := make(map[int]int)
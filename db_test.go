@@ -2,6 +2,7 @@ package main
 
 import (
 	"os"
+	"sort"
 	"strings"
 	"testing"
 
@@ -20,6 +21,42 @@ create table received_messages(
 
 	primary key(uuid, node_id)
 );
+
+create table dropped_messages(
+	uuid bigint,
+	node_id varchar(255),
+	tick int,
+	reason varchar(100),
+	label varchar(100)
+);
+
+create table bandwidth(
+	node_id varchar(255),
+	tick int,
+	bytes_sent bigint,
+	bytes_received bigint,
+	label varchar(100),
+
+	primary key(node_id, tick, label)
+);
+
+create table runs(
+	label varchar(100),
+	seed bigint,
+	config text,
+
+	primary key(label)
+);
+
+create table outages(
+	node_id varchar(255),
+	offline_tick int,
+	online_tick int,
+	stale_messages int,
+	label varchar(100),
+
+	primary key(node_id, offline_tick, label)
+);
 `
 
 func connectAndResetForTesting(t *testing.T) *labelledDB {
@@ -253,3 +290,119 @@ func TestGetDuplicateBucket(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, 0, count)
 }
+
+func TestGetBandwidth(t *testing.T) {
+	dbc := connectAndResetForTesting(t)
+
+	sent, received, err := GetBandwidth(dbc, "node 1")
+	require.NoError(t, err)
+	require.Equal(t, 0, sent)
+	require.Equal(t, 0, received)
+
+	require.NoError(t, WriteBandwidth(dbc, "node 1", 1, 100, 20))
+	require.NoError(t, WriteBandwidth(dbc, "node 1", 2, 50, 0))
+	require.NoError(t, WriteBandwidth(dbc, "node 2", 1, 20, 100))
+
+	sent, received, err = GetBandwidth(dbc, "node 1")
+	require.NoError(t, err)
+	require.Equal(t, 150, sent)
+	require.Equal(t, 20, received)
+}
+
+func TestGetDroppedCount(t *testing.T) {
+	dbc := connectAndResetForTesting(t)
+
+	uuid := int64(432)
+
+	count, err := GetDroppedCount(dbc, uuid)
+	require.NoError(t, err)
+	require.Equal(t, 0, count)
+
+	err = WriteMessageDropped(dbc, uuid, "node 1", 3, dropReasonRateLimit)
+	require.NoError(t, err)
+
+	err = WriteMessageDropped(dbc, uuid, "node 2", 4, dropReasonRateLimit)
+	require.NoError(t, err)
+
+	count, err = GetDroppedCount(dbc, uuid)
+	require.NoError(t, err)
+	require.Equal(t, 2, count)
+}
+
+func TestWriteRun(t *testing.T) {
+	dbc := connectAndResetForTesting(t)
+
+	_, _, err := GetRun(dbc)
+	require.Error(t, err)
+
+	err = WriteRun(dbc, 42, "protocol=flood seed=42")
+	require.NoError(t, err)
+
+	seed, config, err := GetRun(dbc)
+	require.NoError(t, err)
+	require.Equal(t, int64(42), seed)
+	require.Equal(t, "protocol=flood seed=42", config)
+}
+
+func TestGetStaleness(t *testing.T) {
+	dbc := connectAndResetForTesting(t)
+
+	outages, stale, err := GetStaleness(dbc, "node 1")
+	require.NoError(t, err)
+	require.Equal(t, 0, outages)
+	require.Equal(t, 0, stale)
+
+	require.NoError(t, WriteOutage(dbc, "node 1", 2, 5, 10))
+	require.NoError(t, WriteOutage(dbc, "node 1", 8, 9, 3))
+	require.NoError(t, WriteOutage(dbc, "node 2", 2, 5, 7))
+
+	outages, stale, err = GetStaleness(dbc, "node 1")
+	require.NoError(t, err)
+	require.Equal(t, 2, outages)
+	require.Equal(t, 13, stale)
+}
+
+func TestWriteBuffer(t *testing.T) {
+	direct := connectAndResetForTesting(t)
+	buffered := connectAndResetForTesting(t)
+
+	writes := []struct {
+		uuid int64
+		node string
+		tick int
+	}{
+		{1, "nodeA", 0},
+		{1, "nodeB", 1},
+		{1, "nodeA", 2},
+		{2, "nodeA", 2},
+		{1, "nodeA", 3},
+	}
+
+	buffer := buffered.buffered()
+	for _, w := range writes {
+		require.NoError(t, WriteMessageSeen(direct, w.uuid, w.node, w.tick))
+		require.NoError(t, WriteMessageSeen(buffer, w.uuid, w.node, w.tick))
+	}
+	require.NoError(t, WriteMessageDropped(direct, 2, "nodeB", 3, "test"))
+	require.NoError(t, WriteMessageDropped(buffer, 2, "nodeB", 3, "test"))
+
+	// Nothing is written until the buffer is flushed.
+	count, err := GetDuplicateBucket(buffered, 1, 0)
+	require.NoError(t, err)
+	require.Zero(t, count)
+
+	require.NoError(t, buffer.writes.flush(buffered))
+
+	directSummary, err := GetSummary(direct)
+	require.NoError(t, err)
+	bufferedSummary, err := GetSummary(buffered)
+	require.NoError(t, err)
+
+	sort.Slice(directSummary, func(i, j int) bool {
+		return directSummary[i].messageID < directSummary[j].messageID
+	})
+	sort.Slice(bufferedSummary, func(i, j int) bool {
+		return bufferedSummary[i].messageID < bufferedSummary[j].messageID
+	})
+	require.Equal(t, directSummary, bufferedSummary)
+}
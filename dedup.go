@@ -0,0 +1,273 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"time"
+)
+
+var (
+	dedupStrategy = flag.String("dedup", "window",
+		"strategy used to remove duplicate channel updates read from "+
+			"wirewatcher: none, exact, window or bucket")
+
+	dedupWindow = flag.Duration("dedup_window", 5*time.Minute,
+		"updates with the same policy as the most recent update for their "+
+			"channel within this window are duplicates with the window "+
+			"strategy")
+)
+
+// DedupStrategy removes duplicate channel updates from the updates read from
+// the wirewatcher DB, which records an update each time it is received.
+type DedupStrategy interface {
+	// Filter returns the updates that are not duplicates, keeping their
+	// order. Strategies may keep state between calls, so updates must be
+	// provided in timestamp order and batches must hold whole buckets.
+	Filter(updates []dbChanUpdate) []dbChanUpdate
+
+	// String returns the name of the strategy.
+	String() string
+}
+
+// ParseDedupStrategy returns the dedup strategy with the name provided:
+//   - none keeps every update.
+//   - exact removes updates with the same timestamp and policy as an update
+//     already seen for the channel, which are the same signed update
+//     received from several peers.
+//   - window removes updates with the same policy as the most recent update
+//     for the channel direction if they are less than window apart.
+//   - bucket keeps only the newest update for each channel direction in each
+//     tick counted from the start time.
+func ParseDedupStrategy(name string, window time.Duration, startTime time.Time,
+	tick time.Duration) (DedupStrategy, error) {
+
+	switch name {
+	case "none":
+		return noDedup{}, nil
+
+	case "exact":
+		return &exactDedup{
+			seen: make(map[exactKey]bool),
+		}, nil
+
+	case "window":
+		return &windowDedup{
+			window: window,
+			recent: make(map[updateKey]dbChanUpdate),
+		}, nil
+
+	case "bucket":
+		return &bucketDedup{
+			start: startTime,
+			tick:  tick,
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown dedup strategy: %v", name)
+	}
+}
+
+// dedupStrategies holds the names of the strategies that ParseDedupStrategy
+// accepts.
+var dedupStrategies = []string{"none", "exact", "window", "bucket"}
+
+// dedupCounts runs every dedup strategy over the updates read, so that the
+// number of updates that each would remove can be compared in a single run.
+type dedupCounts struct {
+	strategies []DedupStrategy
+	removed    []int
+}
+
+func newDedupCounts(window time.Duration, startTime time.Time,
+	tick time.Duration) (*dedupCounts, error) {
+
+	counts := &dedupCounts{
+		removed: make([]int, len(dedupStrategies)),
+	}
+
+	for _, name := range dedupStrategies {
+		strategy, err := ParseDedupStrategy(name, window, startTime,
+			tick)
+		if err != nil {
+			return nil, err
+		}
+
+		counts.strategies = append(counts.strategies, strategy)
+	}
+
+	return counts, nil
+}
+
+// add filters a batch of updates with each strategy, counting the updates
+// that it removes.
+func (d *dedupCounts) add(updates []dbChanUpdate) {
+	for i, strategy := range d.strategies {
+		d.removed[i] += len(updates) - len(strategy.Filter(updates))
+	}
+}
+
+// log logs the number of updates that each strategy removed.
+func (d *dedupCounts) log(total int) {
+	for i, strategy := range d.strategies {
+		log.Printf("Dedup %v removes %v of %v updates", strategy,
+			d.removed[i], total)
+	}
+}
+
+// updateKey identifies the channel direction that an update sets the policy
+// for, since each of a channel's nodes sends its own updates.
+type updateKey struct {
+	chanID    string
+	direction int
+}
+
+func newUpdateKey(update dbChanUpdate) updateKey {
+	return updateKey{
+		chanID:    update.chanID,
+		direction: update.chanFlags & chanFlagDirection,
+	}
+}
+
+// noDedup keeps every update.
+type noDedup struct{}
+
+func (noDedup) Filter(updates []dbChanUpdate) []dbChanUpdate {
+	return updates
+}
+
+func (noDedup) String() string {
+	return "none"
+}
+
+// exactKey identifies a signed update.
+type exactKey struct {
+	chanPolicy
+
+	chanID string
+	ts     int64
+}
+
+// exactDedup removes updates that are identical to an update already seen.
+type exactDedup struct {
+	seen map[exactKey]bool
+}
+
+func (e *exactDedup) Filter(updates []dbChanUpdate) []dbChanUpdate {
+	var unique []dbChanUpdate
+	for _, update := range updates {
+		key := exactKey{
+			chanPolicy: update.chanPolicy,
+			chanID:     update.chanID,
+			ts:         update.ts.UnixNano(),
+		}
+		if e.seen[key] {
+			continue
+		}
+		e.seen[key] = true
+
+		unique = append(unique, update)
+	}
+
+	return unique
+}
+
+func (e *exactDedup) String() string {
+	return "exact"
+}
+
+// windowDedup removes updates that set the same policy as the most recent
+// update for their channel within a time window.
+type windowDedup struct {
+	window time.Duration
+
+	// recent holds the most recent update we have kept for each channel
+	// direction.
+	recent map[updateKey]dbChanUpdate
+}
+
+func (w *windowDedup) Filter(updates []dbChanUpdate) []dbChanUpdate {
+	var unique []dbChanUpdate
+	for _, update := range updates {
+		recent, ok := w.recent[newUpdateKey(update)]
+		if ok && w.isDuplicate(recent, update) {
+			continue
+		}
+
+		unique = append(unique, update)
+
+		// if the update is more recent than the one we have on record,
+		// replace it so that we compare later updates with it
+		if !ok || recent.ts.Before(update.ts) {
+			w.recent[newUpdateKey(update)] = update
+		}
+	}
+
+	return unique
+}
+
+func (w *windowDedup) isDuplicate(recent, update dbChanUpdate) bool {
+	// updates that are further apart than our window are not duplicates
+	gap := recent.ts.Sub(update.ts)
+	if gap < 0 {
+		gap = -gap
+	}
+	if gap > w.window {
+		return false
+	}
+
+	// if updates differ on any dimension they are not duplicates
+	return recent.chanPolicy == update.chanPolicy
+}
+
+func (w *windowDedup) String() string {
+	return fmt.Sprintf("window(%v)", w.window)
+}
+
+// bucketDedup keeps only the newest update for each channel direction in each
+// bucket, since nodes only relay the newest version of a message that they
+// receive.
+type bucketDedup struct {
+	start time.Time
+	tick  time.Duration
+}
+
+func (b *bucketDedup) Filter(updates []dbChanUpdate) []dbChanUpdate {
+	type key struct {
+		updateKey
+		bucket int
+	}
+
+	// find the index of the newest update for each channel direction and
+	// bucket, later updates win ties
+	newest := make(map[key]int)
+	for i, update := range updates {
+		k := key{
+			updateKey: newUpdateKey(update),
+			bucket:    bucketIndex(update.ts, b.start, b.tick),
+		}
+
+		if j, ok := newest[k]; ok && update.ts.Before(updates[j].ts) {
+			continue
+		}
+		newest[k] = i
+	}
+
+	var unique []dbChanUpdate
+	for i, update := range updates {
+		k := key{
+			updateKey: newUpdateKey(update),
+			bucket:    bucketIndex(update.ts, b.start, b.tick),
+		}
+
+		if newest[k] == i {
+			unique = append(unique, update)
+		}
+	}
+
+	return unique
+}
+
+func (b *bucketDedup) String() string {
+	return "bucket"
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+var linkDelay = flag.String("link_delay", "uniform:100ms-500ms",
+	"distribution of the time messages take to cross a link in the event "+
+		"engine: fixed:<delay>, uniform:<min>-<max> or "+
+		"exponential:<mean>")
+
+// DelayDistribution is the distribution of the time that messages take to
+// cross a link.
+type DelayDistribution interface {
+	// Sample returns a delay drawn from the distribution.
+	Sample(r *rand.Rand) time.Duration
+
+	String() string
+}
+
+// ParseDelayDistribution parses a delay distribution in the format used by
+// the link_delay flag.
+func ParseDelayDistribution(dist string) (DelayDistribution, error) {
+	parts := strings.SplitN(dist, ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("delay distribution must be in the form "+
+			"name:parameters, got: %v", dist)
+	}
+
+	switch parts[0] {
+	case "fixed":
+		delay, err := parseDelay(parts[1])
+		if err != nil {
+			return nil, err
+		}
+
+		return fixedDelay(delay), nil
+
+	case "uniform":
+		bounds := strings.SplitN(parts[1], "-", 2)
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("uniform delay must be in the form "+
+				"uniform:<min>-<max>, got: %v", dist)
+		}
+
+		min, err := parseDelay(bounds[0])
+		if err != nil {
+			return nil, err
+		}
+
+		max, err := parseDelay(bounds[1])
+		if err != nil {
+			return nil, err
+		}
+
+		if max < min {
+			return nil, fmt.Errorf("uniform delay maximum %v is less "+
+				"than minimum %v", max, min)
+		}
+
+		return &uniformDelay{min: min, max: max}, nil
+
+	case "exponential":
+		mean, err := parseDelay(parts[1])
+		if err != nil {
+			return nil, err
+		}
+
+		return exponentialDelay(mean), nil
+
+	default:
+		return nil, fmt.Errorf("unknown delay distribution: %v", parts[0])
+	}
+}
+
+func parseDelay(delay string) (time.Duration, error) {
+	d, err := time.ParseDuration(delay)
+	if err != nil {
+		return 0, err
+	}
+
+	if d < 0 {
+		return 0, fmt.Errorf("delay must not be negative, got: %v", d)
+	}
+
+	return d, nil
+}
+
+// fixedDelay delays every message by the same amount.
+type fixedDelay time.Duration
+
+func (f fixedDelay) Sample(*rand.Rand) time.Duration {
+	return time.Duration(f)
+}
+
+func (f fixedDelay) String() string {
+	return fmt.Sprintf("fixed:%v", time.Duration(f))
+}
+
+// uniformDelay delays messages by a uniformly distributed amount between min
+// and max.
+type uniformDelay struct {
+	min time.Duration
+	max time.Duration
+}
+
+func (u *uniformDelay) Sample(r *rand.Rand) time.Duration {
+	if u.max == u.min {
+		return u.min
+	}
+
+	return u.min + time.Duration(r.Int63n(int64(u.max-u.min)+1))
+}
+
+func (u *uniformDelay) String() string {
+	return fmt.Sprintf("uniform:%v-%v", u.min, u.max)
+}
+
+// exponentialDelay delays messages by an exponentially distributed amount
+// with the mean provided, which gives a long tail of slow deliveries.
+type exponentialDelay time.Duration
+
+func (e exponentialDelay) Sample(r *rand.Rand) time.Duration {
+	return time.Duration(r.ExpFloat64() * float64(e))
+}
+
+func (e exponentialDelay) String() string {
+	return fmt.Sprintf("exponential:%v", time.Duration(e))
+}
+
+// link is a directed connection from one node to another.
+type link struct {
+	from string
+	to   string
+}
+
+// LinkDelays holds the delay distribution of each link in the graph. Links
+// that have not been set use the default distribution.
+type LinkDelays struct {
+	Default DelayDistribution
+
+	links map[link]DelayDistribution
+	rand  *rand.Rand
+}
+
+// NewLinkDelays returns link delays which use the default distribution for
+// every link until they are set, sampled with the seed provided.
+func NewLinkDelays(def DelayDistribution, seed int64) *LinkDelays {
+	return &LinkDelays{
+		Default: def,
+		links:   make(map[link]DelayDistribution),
+		rand:    rand.New(rand.NewSource(seed)),
+	}
+}
+
+// SetLink sets the delay distribution for messages sent from one node to
+// another.
+func (l *LinkDelays) SetLink(from, to string, dist DelayDistribution) {
+	l.links[link{from: from, to: to}] = dist
+}
+
+// Sample returns the time a message sent from one node to another takes to
+// arrive.
+func (l *LinkDelays) Sample(from, to string) time.Duration {
+	dist, ok := l.links[link{from: from, to: to}]
+	if !ok {
+		dist = l.Default
+	}
+
+	return dist.Sample(l.rand)
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// DependencyMode sets how nodes handle gossip that arrives before the
+// messages that it depends on, following the rules in BOLT 7: a
+// channel_update must follow the channel_announcement for its channel, and a
+// node_announcement must follow a channel_announcement for the node.
+type DependencyMode int
+
+const (
+	// DependenciesOff accepts all messages regardless of dependencies.
+	DependenciesOff DependencyMode = iota
+
+	// DependenciesDefer holds messages back until the announcement that
+	// they depend on arrives, and then processes them.
+	DependenciesDefer
+
+	// DependenciesReject drops messages that arrive before the
+	// announcement that they depend on.
+	DependenciesReject
+)
+
+// ParseDependencyMode parses a dependency mode flag.
+func ParseDependencyMode(mode string) (DependencyMode, error) {
+	switch mode {
+	case "off":
+		return DependenciesOff, nil
+
+	case "defer":
+		return DependenciesDefer, nil
+
+	case "reject":
+		return DependenciesReject, nil
+
+	default:
+		return 0, fmt.Errorf("unknown dependency mode: %v", mode)
+	}
+}
+
+// dropReasonDependency is recorded for messages rejected because the
+// announcement they depend on has not been received.
+const dropReasonDependency = "missing_dependency"
+
+// DependencyValidated is implemented by nodes that can check the
+// dependencies of the messages they receive.
+type DependencyValidated interface {
+	// SetDependencies sets the tracker used to check the dependencies of
+	// new messages from peers.
+	SetDependencies(deps *Dependencies)
+
+	// GetDependencies returns the node's dependency tracker, or nil if
+	// dependencies are not checked.
+	GetDependencies() *Dependencies
+}
+
+// GraphChannels is the set of channels, and the nodes that have them, in the
+// channel graph that the simulation starts with. All nodes are assumed to
+// have the announcements for these channels, and it is shared between nodes
+// so that each node only needs to store the announcements it learns about
+// during the simulation. It also holds the address type of each node in the
+// graph.
+type GraphChannels struct {
+	// channels maps short channel ID to the channel's two nodes.
+	channels map[string][2]string
+	nodes    map[string]bool
+
+	// addresses maps a node to the type of the addresses it advertises.
+	addresses map[string]AddressType
+}
+
+// NewGraphChannels returns an empty set of graph channels.
+func NewGraphChannels() *GraphChannels {
+	return &GraphChannels{
+		channels:  make(map[string][2]string),
+		nodes:     make(map[string]bool),
+		addresses: make(map[string]AddressType),
+	}
+}
+
+// SetAddresses sets a node's address type from the addresses it advertises.
+func (g *GraphChannels) SetAddresses(node string, addresses []string) {
+	g.addresses[node] = ClassifyAddresses(addresses)
+}
+
+// AddressType returns the address type of a node, nodes that we have no
+// addresses for are unknown.
+func (g *GraphChannels) AddressType(node string) AddressType {
+	return g.addresses[node]
+}
+
+// AddChannel adds a channel between two nodes to the graph.
+func (g *GraphChannels) AddChannel(chanID uint64, node1, node2 string) {
+	g.channels[strconv.FormatUint(chanID, 10)] = [2]string{node1, node2}
+	g.nodes[node1] = true
+	g.nodes[node2] = true
+}
+
+// deferredMessage is a message held until its dependency arrives.
+type deferredMessage struct {
+	msg  Message
+	from string
+}
+
+// Dependencies tracks the announcements that a node knows about, and the
+// messages that it is holding back until their announcements arrive.
+type Dependencies struct {
+	Mode DependencyMode
+
+	// Rejected is the number of messages dropped for missing dependencies.
+	Rejected int
+
+	// Deferred is the number of messages that were held back until their
+	// dependencies arrived.
+	Deferred int
+
+	graph    *GraphChannels
+	channels map[string]bool
+	nodes    map[string]bool
+
+	// waitingChannel and waitingNode hold deferred messages by the short
+	// channel ID or node that they are waiting on an announcement for.
+	waitingChannel map[string][]deferredMessage
+	waitingNode    map[string][]deferredMessage
+}
+
+// NewDependencies returns a dependency tracker for a node that starts out
+// knowing about the channels in graph, which may be nil.
+func NewDependencies(mode DependencyMode, graph *GraphChannels) *Dependencies {
+	if graph == nil {
+		graph = NewGraphChannels()
+	}
+
+	return &Dependencies{
+		Mode:           mode,
+		graph:          graph,
+		channels:       make(map[string]bool),
+		nodes:          make(map[string]bool),
+		waitingChannel: make(map[string][]deferredMessage),
+		waitingNode:    make(map[string][]deferredMessage),
+	}
+}
+
+// Pending returns the number of messages still waiting on dependencies.
+func (d *Dependencies) Pending() int {
+	var pending int
+	for _, waiting := range d.waitingChannel {
+		pending += len(waiting)
+	}
+	for _, waiting := range d.waitingNode {
+		pending += len(waiting)
+	}
+
+	return pending
+}
+
+func (d *Dependencies) knowsChannel(chanID string) bool {
+	_, ok := d.graph.channels[chanID]
+	return d.channels[chanID] || ok
+}
+
+func (d *Dependencies) knowsNode(node string) bool {
+	return d.nodes[node] || d.graph.nodes[node]
+}
+
+// check returns true if the announcement a new message depends on is known.
+// Otherwise the message is deferred or rejected, depending on our mode.
+// All messages pass if the tracker is nil.
+func (d *Dependencies) check(dbc *labelledDB, msg Message, nodeID string,
+	tick int, from string) (bool, error) {
+
+	if d == nil || d.Mode == DependenciesOff {
+		return true, nil
+	}
+
+	var waiting map[string][]deferredMessage
+	var key string
+
+	switch m := msg.(type) {
+	case *ChannelUpdate:
+		if d.knowsChannel(m.chanID) {
+			return true, nil
+		}
+		waiting, key = d.waitingChannel, m.chanID
+
+	case *NodeAnnouncement:
+		if d.knowsNode(m.Node) {
+			return true, nil
+		}
+		waiting, key = d.waitingNode, m.Node
+
+	default:
+		return true, nil
+	}
+
+	if d.Mode == DependenciesReject {
+		d.Rejected++
+		return false, ReportDropped(dbc, msg, nodeID, tick,
+			dropReasonDependency)
+	}
+
+	d.Deferred++
+	waiting[key] = append(waiting[key], deferredMessage{
+		msg:  msg,
+		from: from,
+	})
+
+	return false, nil
+}
+
+// learn records an accepted message, and returns the deferred messages that
+// it releases. It returns nil if the tracker is nil.
+func (d *Dependencies) learn(msg Message) []deferredMessage {
+	if d == nil {
+		return nil
+	}
+
+	announcement, ok := msg.(*ChannelAnnouncement)
+	if !ok {
+		return nil
+	}
+
+	d.channels[announcement.chanID] = true
+	released := d.waitingChannel[announcement.chanID]
+	delete(d.waitingChannel, announcement.chanID)
+
+	for _, node := range announcement.OriginNodes() {
+		d.nodes[node] = true
+		released = append(released, d.waitingNode[node]...)
+		delete(d.waitingNode, node)
+	}
+
+	return released
+}
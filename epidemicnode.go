@@ -0,0 +1,360 @@
+package main
+
+import (
+	"hash/fnv"
+	"math/rand"
+)
+
+// nodeRand returns a source of randomness for a node which is derived from the
+// simulation's seed and the node's pubkey, so that a node makes the same
+// choices in every run with the same seed regardless of the order in which
+// nodes are created.
+func nodeRand(seed int64, pubkey string) *rand.Rand {
+	h := fnv.New64a()
+	h.Write([]byte(pubkey))
+
+	return rand.New(rand.NewSource(seed ^ int64(h.Sum64())))
+}
+
+// MakeEpidemicNode returns a node which pushes new messages to fanout random
+// peers and pulls messages from a random peer with probability pull each tick.
+func MakeEpidemicNode(pubkey string, peers []string, fanout int, pull float64,
+	seed int64) Node {
+
+	return &EpidemicNode{
+		Pubkey:          pubkey,
+		Peers:           peers,
+		Fanout:          fanout,
+		PullProbability: pull,
+		RelayQueue:      make(map[string][]Message),
+		CachedMessages:  make(map[string]Message),
+		pending:         make(map[string][]Message),
+		rand:            nodeRand(seed, pubkey),
+		disconnected:    make(map[string]bool),
+	}
+}
+
+// Puller is implemented by nodes that pull messages from their peers in the
+// background until a pull round finds nothing new.
+type Puller interface {
+	// Received returns true if the node has received a new message since
+	// its pull rounds were last restarted.
+	Received() bool
+
+	// RestartPulls has the node run pull rounds until one finds nothing
+	// it is missing.
+	RestartPulls()
+}
+
+// restartPulls restarts the pull rounds of every node if any node has
+// received a new message, since nodes that have stopped pulling may now be
+// missing it.
+func restartPulls(nodes map[string]Node, pubkeys []string) {
+	var received bool
+	for _, pubkey := range pubkeys {
+		p, ok := nodes[pubkey].(Puller)
+		if ok && p.Received() {
+			received = true
+			break
+		}
+	}
+
+	if !received {
+		return
+	}
+
+	for _, pubkey := range pubkeys {
+		if p, ok := nodes[pubkey].(Puller); ok {
+			p.RestartPulls()
+		}
+	}
+}
+
+// EpidemicNode relays gossip using a textbook push/pull epidemic protocol.
+// When a node receives a new message, it pushes it to Fanout peers chosen at
+// random from the peers that did not send it the message. Each tick, the node
+// also starts a pull round with a random peer with probability
+// PullProbability, using gossip queries to fetch the messages it is missing.
+//
+// So that the simulation can end, nodes stop pulling once a pull round does
+// not find any messages they are missing. Whenever any node in the network
+// receives a new message, the engine restarts every node's pull rounds, so
+// pulling only stops once every node has found nothing new since the network
+// last changed. This lets nodes that were missed by pushes catch up.
+type EpidemicNode struct {
+	// PubKey of the node being represented
+	Pubkey string
+
+	// Pubkeys of peers
+	Peers []string
+
+	// Fanout is the number of peers that new messages are pushed to.
+	Fanout int
+
+	// PullProbability is the probability that we start a pull round in a
+	// tick.
+	PullProbability float64
+
+	// Queue of peer ID -> messages to send to peer this tick
+	RelayQueue map[string][]Message
+
+	// Map protocol ID to the most recent message we have for the ID
+	CachedMessages map[string]Message
+
+	// RateLimiter decides whether we accept new messages from peers, all
+	// messages are accepted if it is nil.
+	RateLimiter RateLimiter
+
+	// Dependencies checks that new messages follow the announcements that
+	// they depend on, dependencies are not checked if it is nil.
+	Dependencies *Dependencies
+
+	// pending is the queue of peer ID -> messages produced while receiving
+	// messages, it becomes the relay queue when the queue is progressed.
+	pending map[string][]Message
+
+	// rand is used for all of the node's random choices.
+	rand *rand.Rand
+
+	// synced is set once a pull round finds nothing we are missing, and
+	// is cleared when our pull rounds are restarted.
+	synced bool
+
+	// stale is set if our pull rounds were restarted while a pull round
+	// was in progress, so that round cannot leave us synced.
+	stale bool
+
+	// received is set if we have received a new message since our pull
+	// rounds were last restarted.
+	received bool
+
+	// awaitingPull is true if we have started a pull round that has not
+	// completed yet, and pullPeer is the peer that we are pulling from.
+	awaitingPull bool
+	pullPeer     string
+
+	// disconnected is the set of peers that we are not connected to, we
+	// do not push to or pull from them.
+	disconnected map[string]bool
+}
+
+func (n *EpidemicNode) GetPubkey() string {
+	return n.Pubkey
+}
+
+func (n *EpidemicNode) AddPeer(peer string) {
+	// do not add duplicate peers
+	for _, p := range n.Peers {
+		if p == peer {
+			return
+		}
+	}
+	n.Peers = append(n.Peers, peer)
+}
+
+func (n *EpidemicNode) GetPeers() []string {
+	return n.Peers
+}
+
+func (n *EpidemicNode) GetMessages() []Message {
+	messages := make([]Message, 0, len(n.CachedMessages))
+	for _, msg := range n.CachedMessages {
+		messages = append(messages, msg)
+	}
+	sortByID(messages)
+
+	return messages
+}
+
+// Holding returns true if we are still running pull rounds.
+func (n *EpidemicNode) Holding() bool {
+	return !n.synced && n.PullProbability > 0 && len(n.connectedPeers()) > 0
+}
+
+// Received returns true if we have received a new message since our pull
+// rounds were last restarted.
+func (n *EpidemicNode) Received() bool {
+	return n.received
+}
+
+// RestartPulls has us run pull rounds until one finds nothing we are
+// missing.
+func (n *EpidemicNode) RestartPulls() {
+	n.synced = false
+	n.stale = n.awaitingPull
+	n.received = false
+}
+
+// connectedPeers returns the peers that we are connected to.
+func (n *EpidemicNode) connectedPeers() []string {
+	if len(n.disconnected) == 0 {
+		return n.Peers
+	}
+
+	var peers []string
+	for _, peer := range n.Peers {
+		if !n.disconnected[peer] {
+			peers = append(peers, peer)
+		}
+	}
+
+	return peers
+}
+
+func (n *EpidemicNode) GetQueue() map[string][]Message {
+	return n.RelayQueue
+}
+
+// ProgressQueue starts a pull round with a random peer with probability
+// PullProbability, then moves the messages queued this tick into the relay
+// queue.
+func (n *EpidemicNode) ProgressQueue() {
+	peers := n.connectedPeers()
+	if !n.synced && !n.awaitingPull && len(peers) > 0 &&
+		n.rand.Float64() < n.PullProbability {
+
+		n.QueryPeer(peers[n.rand.Intn(len(peers))])
+	}
+
+	n.RelayQueue = n.pending
+	n.pending = make(map[string][]Message)
+}
+
+// QueryPeer starts a pull round with a peer.
+func (n *EpidemicNode) QueryPeer(peer string) {
+	n.awaitingPull = true
+	n.stale = false
+	n.pullPeer = peer
+	n.pending[peer] = append(n.pending[peer], &queryChannelRange{})
+}
+
+// PeerDisconnected gives up on a pull round with a peer, so that we pull from
+// another peer instead.
+func (n *EpidemicNode) PeerDisconnected(peer string) {
+	n.disconnected[peer] = true
+
+	if n.awaitingPull && n.pullPeer == peer {
+		n.awaitingPull = false
+	}
+}
+
+// PeerConnected lets us push to and pull from a peer again.
+func (n *EpidemicNode) PeerConnected(peer string) {
+	delete(n.disconnected, peer)
+}
+
+// SetRateLimiter sets the limiter used for new messages from peers.
+func (n *EpidemicNode) SetRateLimiter(limiter RateLimiter) {
+	n.RateLimiter = limiter
+}
+
+// SetDependencies sets the tracker used to check the dependencies of new
+// messages from peers.
+func (n *EpidemicNode) SetDependencies(deps *Dependencies) {
+	n.Dependencies = deps
+}
+
+// GetDependencies returns the node's dependency tracker.
+func (n *EpidemicNode) GetDependencies() *Dependencies {
+	return n.Dependencies
+}
+
+// ReceiveMessage handles gossip queries and full messages from peers. Only
+// full messages are reported in the metrics store.
+func (n *EpidemicNode) ReceiveMessage(dbc *labelledDB, msg Message, tick int, from string) error {
+	switch m := msg.(type) {
+	case *queryChannelRange:
+		n.pending[from] = append(n.pending[from], rangeReply(n.GetMessages()))
+
+	case *replyChannelRange:
+		missing := missingEntries(m, n.cached)
+
+		// the pull round found nothing new, so we stop pulling until
+		// our pull rounds are restarted
+		if len(missing) == 0 {
+			n.awaitingPull = false
+			n.synced = !n.stale
+			return nil
+		}
+
+		n.pending[from] = append(n.pending[from], &queryShortChanIDs{
+			ids: missing,
+		})
+
+	case *queryShortChanIDs:
+		for _, id := range m.ids {
+			if cached, ok := n.CachedMessages[id]; ok {
+				n.pending[from] = append(n.pending[from], cached)
+			}
+		}
+		n.pending[from] = append(n.pending[from], &replyShortChanIDsEnd{})
+
+	case *replyShortChanIDsEnd:
+		n.awaitingPull = false
+
+	default:
+		return n.receiveFull(dbc, msg, tick, from)
+	}
+
+	return nil
+}
+
+// cached returns the message we have cached for an ID.
+func (n *EpidemicNode) cached(id string) (Message, bool) {
+	cached, ok := n.CachedMessages[id]
+	return cached, ok
+}
+
+// receiveFull caches a full message and pushes it to Fanout random peers that
+// did not send it to us if it is new.
+func (n *EpidemicNode) receiveFull(dbc *labelledDB, msg Message, tick int, from string) error {
+	cached, ok := n.CachedMessages[msg.ID()]
+	if ok && !cached.TimeStamp().Before(msg.TimeStamp()) {
+		return ReportMessage(dbc, msg, n.Pubkey, tick)
+	}
+
+	// new messages must follow their dependencies and pass our rate limit
+	// before we accept them
+	ok, err := n.Dependencies.check(dbc, msg, n.Pubkey, tick, from)
+	if err != nil || !ok {
+		return err
+	}
+
+	ok, err = admit(dbc, n.RateLimiter, msg, n.Pubkey, tick, from)
+	if err != nil || !ok {
+		return err
+	}
+
+	if err := ReportMessage(dbc, msg, n.Pubkey, tick); err != nil {
+		return err
+	}
+
+	n.CachedMessages[msg.ID()] = msg
+	n.received = true
+
+	var candidates []string
+	for _, peer := range n.connectedPeers() {
+		if peer != from && relayable(n.Pubkey, msg) {
+			candidates = append(candidates, peer)
+		}
+	}
+
+	n.rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+
+	for i := 0; i < n.Fanout && i < len(candidates); i++ {
+		peer := candidates[i]
+		n.pending[peer] = append(n.pending[peer], msg)
+	}
+
+	// process any messages that were waiting on this one
+	for _, deferred := range n.Dependencies.learn(msg) {
+		err := n.receiveFull(dbc, deferred.msg, tick, deferred.from)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
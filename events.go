@@ -0,0 +1,533 @@
+package main
+
+import (
+	"container/heap"
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+var (
+	engine = flag.String("engine", "tick",
+		"simulation engine: tick moves every message one hop per tick, "+
+			"event delivers messages after the delay of their link")
+
+	eventStep = flag.Duration("event_step", 100*time.Millisecond,
+		"time between the steps at which nodes process the messages "+
+			"they have received in the event engine")
+)
+
+// Engine advances a simulation of the network.
+type Engine interface {
+	// Tick advances the simulation to the next point in time at which
+	// nodes process messages.
+	Tick(dbc *labelledDB, mMgr MessageManager) (*tickResult, error)
+}
+
+// delivery is a message that will arrive at a node at a point in time.
+type delivery struct {
+	at   time.Duration
+	seq  uint64
+	from string
+	to   string
+	msg  Message
+}
+
+// deliveryQueue is a priority queue of deliveries, ordered by arrival time
+// and then by the order they were sent in.
+type deliveryQueue []*delivery
+
+func (d deliveryQueue) Len() int { return len(d) }
+
+func (d deliveryQueue) Less(i, j int) bool {
+	if d[i].at != d[j].at {
+		return d[i].at < d[j].at
+	}
+
+	return d[i].seq < d[j].seq
+}
+
+func (d deliveryQueue) Swap(i, j int) { d[i], d[j] = d[j], d[i] }
+
+func (d *deliveryQueue) Push(x interface{}) {
+	*d = append(*d, x.(*delivery))
+}
+
+func (d *deliveryQueue) Pop() interface{} {
+	old := *d
+	item := old[len(old)-1]
+	*d = old[:len(old)-1]
+
+	return item
+}
+
+// Timed is implemented by nodes whose timers count the times that their queue
+// is progressed. The event engine skips steps in which nothing happens, so it
+// does not skip past a node's next timer, and tells the node how many steps
+// it skipped so that its timers count steps.
+type Timed interface {
+	// NextTimer returns the number of times the queue will be progressed
+	// up to and including the time that the node's next timer fires, and
+	// false if no timer with work to do is set.
+	NextTimer() (int, bool)
+
+	// SkipTicks advances the node's timers by a number of ticks in which
+	// its queue was not progressed.
+	SkipTicks(ticks int)
+}
+
+// origination is a new message that will be originated at a step.
+type origination struct {
+	step int
+	msg  Message
+}
+
+// NewEventGraph returns a discrete-event engine for a set of nodes. Nodes
+// process messages every step, messages are delivered after the delay of
+// their link and new messages are originated at the step their timestamp
+// falls in.
+func NewEventGraph(nodes map[string]Node, delays *LinkDelays, step,
+	tick time.Duration) *EventGraph {
+
+	return &EventGraph{
+		Nodes:     nodes,
+		Delays:    delays,
+		Step:      step,
+		TickSize:  tick,
+		pubkeys:   sortedPubkeys(nodes),
+		linkClear: make(map[link]time.Duration),
+	}
+}
+
+// EventGraph is a discrete-event engine which drives the same nodes as
+// ChannelGraph, but delivers each message after the delay of the link it is
+// sent over rather than one tick after it was sent. Time is divided into
+// steps, which are much shorter than a tick. At each step nodes receive the
+// messages that have arrived and progress their queues, and the messages
+// they queue are scheduled for delivery. Nodes are given the step as their
+// tick, so metrics and node timers that count ticks count steps.
+type EventGraph struct {
+	// map of pubkey to node implementation
+	Nodes map[string]Node
+
+	// Delays samples the delay of each message sent between peers.
+	Delays *LinkDelays
+
+	// Step is the time between the steps at which nodes process messages.
+	Step time.Duration
+
+	// TickSize is the time each tick of messages from the message manager
+	// represents.
+	TickSize time.Duration
+
+	// StepCount is the number of the next step to be run.
+	StepCount int
+
+	// AntiEntropy repairs gaps in the messages nodes have in the
+	// background, it is disabled if nil. Its interval is counted in steps.
+	AntiEntropy *AntiEntropy
+
+	// Churn takes nodes offline and brings them back online, all nodes
+	// stay online if it is nil. Its schedule is counted in steps.
+	Churn *Churn
+
+	// Workers is the number of goroutines that nodes receive and progress
+	// messages on, nodes are run one at a time if it is less than two.
+	Workers int
+
+	// pubkeys are the nodes' pubkeys in the order that they send
+	// messages, which is sorted unless it is set by a seed. Delays are
+	// sampled in this order.
+	pubkeys []string
+
+	queue deliveryQueue
+	seq   uint64
+
+	// linkClear holds the time that the last message sent over each link
+	// arrives, so that links deliver messages in the order they are sent.
+	linkClear map[link]time.Duration
+
+	// nextTick is the next tick to read messages for, and messagesDone is
+	// set once the message manager has no more messages.
+	nextTick     int
+	messagesDone bool
+
+	// origins holds the messages that have been read but not yet
+	// originated, in the order that they are originated.
+	origins []origination
+
+	// settled is set once there are no more messages to simulate and
+	// none in flight or held by nodes.
+	settled bool
+}
+
+// SetSeed sets the order that nodes send messages in from a seed.
+func (e *EventGraph) SetSeed(seed int64) {
+	e.pubkeys = nodeOrder(e.Nodes, seed)
+}
+
+// stepAt returns the first step at or after a point in time.
+func (e *EventGraph) stepAt(at time.Duration) int {
+	step := int(at / e.Step)
+	if time.Duration(step)*e.Step < at {
+		step++
+	}
+
+	return step
+}
+
+// Tick runs the current step and moves on to the next step at which there
+// is something to do.
+func (e *EventGraph) Tick(dbc *labelledDB, mMgr MessageManager) (*tickResult,
+	error) {
+
+	result := &tickResult{}
+	now := time.Duration(e.StepCount) * e.Step
+
+	// take nodes offline and bring them back online before anything else
+	// happens in this step
+	if e.Churn != nil {
+		churn, err := e.Churn.Update(dbc, e.Nodes, e.StepCount,
+			e.settled)
+		if err != nil {
+			return nil, err
+		}
+		result.churn = churn
+	}
+
+	// read the messages for each tick that has started, and schedule each
+	// one to be originated at the step that its timestamp falls in
+	for !e.messagesDone &&
+		e.stepAt(time.Duration(e.nextTick)*e.TickSize) <= e.StepCount {
+
+		log.Printf("Reading messages for tick %v at step %v", e.nextTick,
+			e.StepCount)
+
+		messages, done := mMgr.GetNewMessages(e.nextTick)
+		for _, msg := range messages {
+			e.origins = append(e.origins, origination{
+				step: e.stepAt(e.originTime(mMgr, msg, e.nextTick)),
+				msg:  msg,
+			})
+		}
+		sort.SliceStable(e.origins, func(i, j int) bool {
+			return e.origins[i].step < e.origins[j].step
+		})
+
+		e.nextTick++
+		e.messagesDone = done
+	}
+
+	var due []Message
+	for len(e.origins) > 0 && e.origins[0].step <= e.StepCount {
+		due = append(due, e.origins[0].msg)
+		e.origins = e.origins[1:]
+	}
+
+	if len(due) > 0 {
+		err := originate(dbc, e.Nodes, e.Churn, due, e.StepCount,
+			result)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	usage := make(bandwidthUsage)
+
+	// deliver the messages that have arrived by this step, each node
+	// receives its messages in the order that they arrived
+	deliveries := make(map[string][]*delivery)
+	for len(e.queue) > 0 && e.queue[0].at <= now {
+		d := heap.Pop(&e.queue).(*delivery)
+
+		// messages in flight are lost when the connection drops,
+		// because either side went offline
+		if e.Churn.Offline(d.to) || e.Churn.Offline(d.from) {
+			dropped, err := e.Churn.Drop(dbc, d.to,
+				[]Message{d.msg}, e.StepCount)
+			if err != nil {
+				return nil, err
+			}
+			result.churn.dropped += dropped
+
+			continue
+		}
+
+		deliveries[d.to] = append(deliveries[d.to], d)
+		usage.get(d.to).received += d.msg.Size()
+	}
+
+	err := deliverAll(dbc, e.Nodes, e.Workers, e.StepCount, deliveries)
+	if err != nil {
+		return nil, err
+	}
+
+	if e.AntiEntropy != nil {
+		repair, err := e.AntiEntropy.Run(dbc, e.Churn.Online(e.Nodes),
+			e.StepCount, e.settled, usage)
+		if err != nil {
+			return nil, err
+		}
+		result.repair = repair
+		result.bytesSent += repair.bytes
+	}
+
+	restartPulls(e.Nodes, e.pubkeys)
+
+	// progress each online node's queue and send what it queues over its
+	// links
+	active := e.Churn.Active(e.pubkeys, true)
+	progressAll(e.Nodes, active, e.Workers)
+
+	var (
+		queuedItems int
+		holding     bool
+	)
+	for _, pubkey := range active {
+		node := e.Nodes[pubkey]
+
+		queue := node.GetQueue()
+		for _, peer := range sortedPeers(queue) {
+			if _, ok := e.Nodes[peer]; !ok {
+				log.Printf("Tick: could not find %v's peer %v in "+
+					"graph", pubkey, peer)
+				result.peerUnknown++
+				continue
+			}
+			result.peerKnown++
+
+			// offline peers are disconnected, so nothing is sent
+			// to them
+			if e.Churn.Offline(peer) {
+				dropped, err := e.Churn.Drop(dbc, peer,
+					queue[peer], e.StepCount)
+				if err != nil {
+					return nil, err
+				}
+				result.churn.dropped += dropped
+
+				continue
+			}
+
+			for _, msg := range queue[peer] {
+				e.send(now, pubkey, peer, msg)
+				queuedItems++
+
+				usage.get(pubkey).sent += msg.Size()
+				result.bytesSent += msg.Size()
+			}
+		}
+
+		if node.Holding() {
+			holding = true
+		}
+	}
+
+	if err := usage.write(dbc, e.StepCount); err != nil {
+		return nil, err
+	}
+
+	if queuedItems > 0 {
+		log.Printf("Step %v (%v): sent %v messages (%v bytes), %v in "+
+			"flight", e.StepCount, now, queuedItems, result.bytesSent,
+			len(e.queue))
+	}
+
+	e.settled = e.messagesDone && len(e.origins) == 0 &&
+		len(e.queue) == 0 && !holding
+	result.done = e.settled && !e.Churn.Waiting() && e.AntiEntropy.Done()
+	next := e.nextStep(holding, active)
+	e.skipSteps(active, next-e.StepCount-1)
+	e.StepCount = next
+	result.tickCount = e.StepCount
+
+	return result, nil
+}
+
+// originTime returns the point in the simulation at which a message read for
+// a tick is originated. This is the message's timestamp if the message
+// manager knows when the first tick starts, and the start of the tick if it
+// does not or if the timestamp falls outside of the tick.
+func (e *EventGraph) originTime(mMgr MessageManager, msg Message,
+	tick int) time.Duration {
+
+	start := time.Duration(tick) * e.TickSize
+
+	timed, ok := mMgr.(TimedMessageManager)
+	if !ok || timed.StartTime().IsZero() {
+		return start
+	}
+
+	at := msg.TimeStamp().Sub(timed.StartTime())
+	if at < start || at >= start+e.TickSize {
+		return start
+	}
+
+	return at
+}
+
+// send schedules delivery of a message over a link. Links deliver messages
+// in the order that they were sent, so a message never arrives before one
+// sent ahead of it.
+func (e *EventGraph) send(now time.Duration, from, to string, msg Message) {
+	l := link{from: from, to: to}
+
+	at := now + e.Delays.Sample(from, to)
+	if clear := e.linkClear[l]; at < clear {
+		at = clear
+	}
+	e.linkClear[l] = at
+
+	e.seq++
+	heap.Push(&e.queue, &delivery{
+		at:   at,
+		seq:  e.seq,
+		from: from,
+		to:   to,
+		msg:  msg,
+	})
+}
+
+// nextStep returns the next step that has work to do. While nodes are
+// holding messages every step is run, since they rely on being progressed
+// to release them. Otherwise we skip to the next delivery, tick of new
+// messages to read, message to originate, anti-entropy round, node going
+// offline or online, or node timer of an active node.
+func (e *EventGraph) nextStep(holding bool, active []string) int {
+	next := e.StepCount + 1
+	if holding {
+		return next
+	}
+
+	var candidates []int
+	if len(e.queue) > 0 {
+		candidates = append(candidates, e.stepAt(e.queue[0].at))
+	}
+	if !e.messagesDone {
+		candidates = append(candidates,
+			e.stepAt(time.Duration(e.nextTick)*e.TickSize))
+	}
+	if len(e.origins) > 0 {
+		candidates = append(candidates, e.origins[0].step)
+	}
+	if step, ok := e.Churn.NextChange(); ok {
+		candidates = append(candidates, step)
+	}
+	if e.AntiEntropy != nil && e.AntiEntropy.Interval > 0 {
+		interval := e.AntiEntropy.Interval
+		candidates = append(candidates,
+			(e.StepCount/interval+1)*interval)
+	}
+	for _, pubkey := range active {
+		timed, ok := e.Nodes[pubkey].(Timed)
+		if !ok {
+			continue
+		}
+
+		if ticks, ok := timed.NextTimer(); ok {
+			candidates = append(candidates, e.StepCount+ticks)
+		}
+	}
+
+	if len(candidates) == 0 {
+		return next
+	}
+
+	earliest := candidates[0]
+	for _, step := range candidates[1:] {
+		if step < earliest {
+			earliest = step
+		}
+	}
+
+	if earliest < next {
+		return next
+	}
+
+	return earliest
+}
+
+// skipSteps advances the timers of the active nodes by the steps that were
+// skipped, in which they would have been progressed. Nodes only go offline or
+// come back online at steps that are run, so the same nodes are active in
+// every step skipped.
+func (e *EventGraph) skipSteps(active []string, steps int) {
+	if steps <= 0 {
+		return
+	}
+
+	for _, pubkey := range active {
+		if timed, ok := e.Nodes[pubkey].(Timed); ok {
+			timed.SkipTicks(steps)
+		}
+	}
+}
+
+// newEngine returns the engine set by flags for a set of nodes, and the
+// amount of time that each of its ticks represents. The graph is only needed
+// if link delays are set from node addresses.
+func newEngine(nodes map[string]Node, graph *GraphChannels) (Engine,
+	time.Duration, error) {
+
+	var antiEntropy *AntiEntropy
+	if *antiEntropyInterval > 0 {
+		antiEntropy = NewAntiEntropy(durationTicks(*antiEntropyInterval),
+			*antiEntropyPairs, *antiEntropyRounds, *seed)
+	}
+
+	churn, err := newChurn(nodes)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	switch *engine {
+	case "tick":
+		if *addressDelays {
+			return nil, 0, fmt.Errorf("address delays are only " +
+				"used by the event engine")
+		}
+
+		chanGraph := NewChannelGraph(nodes)
+		chanGraph.AntiEntropy = antiEntropy
+		chanGraph.Churn = churn
+		chanGraph.Workers = *workers
+		chanGraph.SetSeed(*seed)
+
+		return chanGraph, tickDuration(), nil
+
+	case "event":
+		if *eventStep <= 0 {
+			return nil, 0, fmt.Errorf("event step must be positive, "+
+				"got: %v", *eventStep)
+		}
+
+		dist, err := ParseDelayDistribution(*linkDelay)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		delays := NewLinkDelays(dist, *seed)
+		if *addressDelays {
+			if graph == nil {
+				return nil, 0, fmt.Errorf("address delays need a " +
+					"channel graph")
+			}
+
+			addressDelayConfig().Apply(delays, nodes, graph)
+		}
+
+		eventGraph := NewEventGraph(nodes, delays, *eventStep,
+			tickDuration())
+		eventGraph.AntiEntropy = antiEntropy
+		eventGraph.Churn = churn
+		eventGraph.Workers = *workers
+		eventGraph.SetSeed(*seed)
+
+		return eventGraph, *eventStep, nil
+
+	default:
+		return nil, 0, fmt.Errorf("unknown engine: %v", *engine)
+	}
+}
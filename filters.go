@@ -0,0 +1,139 @@
+package main
+
+import "time"
+
+var (
+	// AllGossip is a timestamp filter which allows every message.
+	AllGossip = TimestampFilter{EndTimestamp: time.Unix(1<<62, 0)}
+
+	// NoGossip is a timestamp filter which allows no messages, it is used
+	// to turn gossip off for a peer.
+	NoGossip = TimestampFilter{}
+)
+
+// TimestampFilter is the window of message timestamps that a peer asks us to
+// relay with gossip_timestamp_filter. The message expresses the window as a
+// first timestamp and a range, we store the end of the range instead so that
+// the window can cover any timestamp.
+type TimestampFilter struct {
+	FirstTimestamp time.Time
+	EndTimestamp   time.Time
+}
+
+// allows returns true if a timestamp falls inside the filter's window.
+func (f TimestampFilter) allows(ts time.Time) bool {
+	return !ts.Before(f.FirstTimestamp) && ts.Before(f.EndTimestamp)
+}
+
+// sinceFilter returns a filter which allows every message from a point in
+// time onwards. A node that has no messages asks for all of them.
+func sinceFilter(since time.Time) TimestampFilter {
+	if since.IsZero() {
+		since = time.Unix(0, 0)
+	}
+
+	return TimestampFilter{
+		FirstTimestamp: since,
+		EndTimestamp:   AllGossip.EndTimestamp,
+	}
+}
+
+// backlog returns the messages we should send a peer when it sets a filter.
+// Like LND, we send the messages we have inside a filter that starts in the
+// past. The simulation does not track the current time, so filters that start
+// at the zero time, such as AllGossip, are treated as starting now and
+// nothing is sent.
+func (f TimestampFilter) backlog(messages []Message) []Message {
+	if f.FirstTimestamp.IsZero() {
+		return nil
+	}
+
+	var backlog []Message
+	for _, msg := range messages {
+		if f.allows(msg.TimeStamp()) {
+			backlog = append(backlog, msg)
+		}
+	}
+
+	return backlog
+}
+
+// TimestampFilterer is implemented by nodes that support
+// gossip_timestamp_filter.
+type TimestampFilterer interface {
+	// SendTimestampFilter queues a gossip_timestamp_filter for a peer,
+	// asking it to only relay messages inside the filter to us.
+	SendTimestampFilter(peer string, filter TimestampFilter)
+
+	// SetPeerFilter applies the filter a peer has asked us to use for the
+	// messages we relay to it. It is used to set up filters that were
+	// exchanged before the simulation started.
+	SetPeerFilter(peer string, filter TimestampFilter)
+}
+
+// gossipTimestampFilter is the message a node sends to set the filter a peer
+// applies to the messages it relays to the node.
+type gossipTimestampFilter struct {
+	controlMessage
+	filter TimestampFilter
+}
+
+func (g *gossipTimestampFilter) Size() int {
+	return gossipTimestampFilterSize
+}
+
+// peerFilters maps a peer to the timestamp filter it has asked for. Peers
+// that have not sent a filter are relayed all messages.
+type peerFilters map[string]TimestampFilter
+
+// allows returns true if a message should be relayed to a peer. Nodes always
+// relay the messages that they originated, regardless of filters, and never
+// relay messages that are not relayable.
+func (p peerFilters) allows(self, peer string, msg Message) bool {
+	if originatedBy(self, msg) {
+		return true
+	}
+
+	if !relayable(self, msg) {
+		return false
+	}
+
+	filter, ok := p[peer]
+	if !ok {
+		return true
+	}
+
+	return filter.allows(msg.TimeStamp())
+}
+
+// originatedBy returns true if a node is one of a message's origin nodes.
+func originatedBy(pubkey string, msg Message) bool {
+	for _, origin := range msg.OriginNodes() {
+		if origin == pubkey {
+			return true
+		}
+	}
+
+	return false
+}
+
+// applyTimestampFilters sets up filters between every node and its peers as
+// if they were exchanged when the peers connected. Each node asks its first
+// activePeers peers for all gossip and turns gossip off for the rest.
+func applyTimestampFilters(nodes map[string]Node, activePeers int) {
+	for pubkey, node := range nodes {
+		for i, peer := range node.GetPeers() {
+			peerNode, ok := nodes[peer].(TimestampFilterer)
+			if !ok {
+				continue
+			}
+
+			filter := NoGossip
+			if i < activePeers {
+				filter = AllGossip
+			}
+
+			peerNode.SetPeerFilter(pubkey, filter)
+		}
+	}
+}
@@ -2,12 +2,15 @@ package main
 
 import (
 	"log"
+	"math/rand"
+	"sort"
 )
 
 func NewChannelGraph(nodes map[string]Node) *ChannelGraph {
 	return &ChannelGraph{
 		Nodes:     nodes,
 		NodeCount: len(nodes),
+		pubkeys:   sortedPubkeys(nodes),
 	}
 }
 
@@ -16,6 +19,56 @@ type ChannelGraph struct {
 	Nodes     map[string]Node
 	TickCount int
 	NodeCount int
+
+	// AntiEntropy repairs gaps in the messages nodes have in the
+	// background, it is disabled if nil.
+	AntiEntropy *AntiEntropy
+
+	// Churn takes nodes offline and brings them back online, all nodes
+	// stay online if it is nil.
+	Churn *Churn
+
+	// Workers is the number of goroutines that nodes receive and progress
+	// messages on, nodes are run one at a time if it is less than two.
+	Workers int
+
+	// pubkeys are the nodes' pubkeys in the order that they send
+	// messages, which is sorted unless it is set by a seed.
+	pubkeys []string
+
+	// settled is set once there are no more messages to simulate and the
+	// network has stopped relaying messages.
+	settled bool
+}
+
+// sortedPubkeys returns the pubkeys of a set of nodes in sorted order.
+func sortedPubkeys(nodes map[string]Node) []string {
+	pubkeys := make([]string, 0, len(nodes))
+	for pubkey := range nodes {
+		pubkeys = append(pubkeys, pubkey)
+	}
+	sort.Strings(pubkeys)
+
+	return pubkeys
+}
+
+// nodeOrder returns the pubkeys of a set of nodes in an order that is fixed
+// by the seed provided. Nodes send their messages in this order, so it
+// decides the order that each node receives messages sent in the same tick.
+func nodeOrder(nodes map[string]Node, seed int64) []string {
+	pubkeys := sortedPubkeys(nodes)
+
+	r := rand.New(rand.NewSource(seed))
+	r.Shuffle(len(pubkeys), func(i, j int) {
+		pubkeys[i], pubkeys[j] = pubkeys[j], pubkeys[i]
+	})
+
+	return pubkeys
+}
+
+// SetSeed sets the order that nodes send messages in from a seed.
+func (c *ChannelGraph) SetSeed(seed int64) {
+	c.pubkeys = nodeOrder(c.Nodes, seed)
 }
 
 type tickResult struct {
@@ -24,11 +77,48 @@ type tickResult struct {
 	nodesKnown  int
 	peerUnknown int
 	peerKnown   int
+	repair      *repairResult
+	churn       *churnResult
+	bytesSent   int
 	done        bool
 }
 
+// bandwidth tracks the bytes a node sent and received in a tick.
+type bandwidth struct {
+	sent     int
+	received int
+}
+
+// bandwidthUsage maps a node's pubkey to the bytes it sent and received in a
+// tick.
+type bandwidthUsage map[string]*bandwidth
+
+func (b bandwidthUsage) get(pubkey string) *bandwidth {
+	u, ok := b[pubkey]
+	if !ok {
+		u = &bandwidth{}
+		b[pubkey] = u
+	}
+
+	return u
+}
+
+// write records the usage of each node for a tick.
+func (b bandwidthUsage) write(dbc *labelledDB, tick int) error {
+	for pubkey, u := range b {
+		err := WriteBandwidth(dbc, pubkey, tick, u.sent, u.received)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // Tick advances the network by one period, where a period represents
-// the exchange of one wire message between peers.
+// the exchange of one wire message between peers. Each tick represents
+// tick_seconds of real time, which is the time a message takes to cross a
+// hop.
 func (c *ChannelGraph) Tick(dbc *labelledDB, mMgr MessageManager) (*tickResult, error) {
 	log.Printf("Running simulation for tick: %v", c.TickCount)
 	result := &tickResult{}
@@ -36,82 +126,181 @@ func (c *ChannelGraph) Tick(dbc *labelledDB, mMgr MessageManager) (*tickResult,
 	// Read in messages and "receive" them at origin nodes. This will be the first
 	// record of the message that the simulation sees.
 	messages, noMessages := mMgr.GetNewMessages(c.TickCount)
-	for _, m := range messages {
-		for _, node := range m.OriginNodes() {
-			// nodes that messages were collected for may not have been online when
-			// the network graph was collected samples, just do not propagate these messages
-			n, ok := c.Nodes[node]
-			if !ok {
-				log.Printf("Tick: cannot find node: %v to originate "+
-					"message: %v", node, m.UUID())
-				result.nodeUnknown++
-				continue
-			}
-			result.nodesKnown++
 
-			// prompt node to receive message so that it queues it for relay
-			// and reports its first sighting for latency measures
-			if err := n.ReceiveMessage(dbc, m, c.TickCount, n.GetPubkey()); err != nil {
-				return nil, err
-			}
+	// take nodes offline and bring them back online before any messages
+	// are sent this tick
+	if c.Churn != nil {
+		churn, err := c.Churn.Update(dbc, c.Nodes, c.TickCount,
+			c.settled)
+		if err != nil {
+			return nil, err
 		}
+		result.churn = churn
 	}
 
-	log.Printf("Added %v messages for propagation", len(messages))
+	err := originate(dbc, c.Nodes, c.Churn, messages, c.TickCount, result)
+	if err != nil {
+		return nil, err
+	}
 
 	// queuedItems monitors whether any messages were sent this round,
 	// it is used to determine whether we should end the simulation or not
 	var queuedItems int
 
-	var nodeProgress int
-	for pubkey, node := range c.Nodes {
-		if nodeProgress%1000 == 0 {
-			log.Printf("Processed sends for %v of %v nodes", nodeProgress, len(c.Nodes))
-		}
+	// usage tracks the bytes each node sends and receives this tick
+	usage := make(bandwidthUsage)
+
+	// deliveries holds the messages sent to each peer, in the order that
+	// they are sent
+	deliveries := make(map[string][]*delivery)
 
+	// offline nodes relay nothing, and nodes that have just come back
+	// online do not send the queue they had when they went offline
+	for _, pubkey := range c.Churn.Active(c.pubkeys, false) {
 		// Get the queue of peer -> message list and send messages to each peer.
-		for peer, messages := range node.GetQueue() {
+		queue := c.Nodes[pubkey].GetQueue()
+		for _, peer := range sortedPeers(queue) {
 			//log.Printf("Node: %v sending: %v messages to %v", pubkey, len(messages), peer)
 
-			receivingPeer, ok := c.Nodes[peer]
-			if !ok {
+			if _, ok := c.Nodes[peer]; !ok {
 				log.Printf("Tick: could not find %v's peer %v in graph", pubkey, peer)
 				result.peerUnknown++
 				continue
 			}
 			result.peerKnown++
 
-			for _, msg := range messages {
+			// offline peers are disconnected, so nothing is sent
+			// to them
+			if c.Churn.Offline(peer) {
+				dropped, err := c.Churn.Drop(dbc, peer,
+					queue[peer], c.TickCount)
+				if err != nil {
+					return nil, err
+				}
+				result.churn.dropped += dropped
+
+				continue
+			}
+
+			for _, msg := range queue[peer] {
 				// track the number of items sent. if there are no items
 				// queued and we are out of messages, then we do not need to continue
 				// the simulation
 				queuedItems++
 
-				// send message to peer
-				if err := receivingPeer.ReceiveMessage(dbc, msg, c.TickCount, node.GetPubkey()); err != nil {
-					return nil, err
-				}
+				deliveries[peer] = append(deliveries[peer], &delivery{
+					from: pubkey,
+					to:   peer,
+					msg:  msg,
+				})
 
+				usage.get(pubkey).sent += msg.Size()
+				usage.get(peer).received += msg.Size()
+				result.bytesSent += msg.Size()
 			}
+		}
+	}
+
+	// send messages to peers
+	err = deliverAll(dbc, c.Nodes, c.Workers, c.TickCount, deliveries)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Propagated %v messages (%v bytes)", queuedItems,
+		result.bytesSent)
 
+	// run anti-entropy after messages have been sent, so that repaired
+	// messages are relayed in the next tick like any other message
+	if c.AntiEntropy != nil {
+		repair, err := c.AntiEntropy.Run(dbc, c.Churn.Online(c.Nodes),
+			c.TickCount, c.settled, usage)
+		if err != nil {
+			return nil, err
 		}
-		nodeProgress++
+		result.repair = repair
+		result.bytesSent += repair.bytes
+
+		log.Printf("Anti-entropy synced %v pairs, repaired %v messages "+
+			"(%v bytes)", repair.pairs, repair.repaired, repair.bytes)
 	}
 
-	log.Printf("Propagated %v messages", queuedItems)
+	if err := usage.write(dbc, c.TickCount); err != nil {
+		return nil, err
+	}
+
+	// restart pull rounds before nodes progress their queues, so that
+	// nodes which stopped pulling check for the new messages
+	restartPulls(c.Nodes, c.pubkeys)
 
 	// progress each node's queue, this is done by clearing the relay queue and
 	// moving the messages received into the relay queue for propagation
-	for _, n := range c.Nodes {
-		n.ProgressQueue()
-	}
+	holding := progressAll(c.Nodes, c.Churn.Active(c.pubkeys, true),
+		c.Workers)
 
 	c.TickCount++
 
-	// if no items were relayed this tick, and we are out of network messages,
-	// then we have finished relaying messages on the network
-	result.done = queuedItems == 0 && noMessages
+	// if no items were relayed this tick, no nodes have messages left to
+	// relay and we are out of network messages, then we have finished
+	// relaying messages on the network. We also wait for offline nodes to
+	// come back online and catch up, and for anti-entropy to find nothing
+	// left to repair.
+	c.settled = queuedItems == 0 && !holding && noMessages
+	result.done = c.settled && !c.Churn.Waiting() && c.AntiEntropy.Done()
 	result.tickCount = c.TickCount
 
 	return result, nil
 }
+
+// originate delivers new messages to the nodes that created them. Messages
+// created by nodes that are offline are dropped.
+func originate(dbc *labelledDB, nodes map[string]Node, churn *Churn,
+	messages []Message, tick int, result *tickResult) error {
+
+	for _, m := range messages {
+		for _, node := range m.OriginNodes() {
+			// nodes that messages were collected for may not have been online when
+			// the network graph was collected samples, just do not propagate these messages
+			n, ok := nodes[node]
+			if !ok {
+				log.Printf("Tick: cannot find node: %v to originate "+
+					"message: %v", node, m.UUID())
+				result.nodeUnknown++
+				continue
+			}
+			result.nodesKnown++
+
+			if churn.Offline(node) {
+				dropped, err := churn.Drop(dbc, node,
+					[]Message{m}, tick)
+				if err != nil {
+					return err
+				}
+				result.churn.dropped += dropped
+
+				continue
+			}
+
+			// prompt node to receive message so that it queues it for relay
+			// and reports its first sighting for latency measures
+			if err := n.ReceiveMessage(dbc, m, tick, n.GetPubkey()); err != nil {
+				return err
+			}
+		}
+	}
+
+	log.Printf("Added %v messages for propagation", len(messages))
+
+	return nil
+}
+
+// sortedPeers returns the peers in a node's queue in sorted order.
+func sortedPeers(queue map[string][]Message) []string {
+	peers := make([]string, 0, len(queue))
+	for peer := range queue {
+		peers = append(peers, peer)
+	}
+	sort.Strings(peers)
+
+	return peers
+}
@@ -0,0 +1,41 @@
+package main
+
+// MakeHybridNode returns a node which floods new messages to its first
+// fanout peers and reconciles them with the rest of its peers every interval
+// ticks.
+func MakeHybridNode(pubkey string, peers []string, fanout, interval int,
+	capacity CapacityEstimator) Node {
+
+	n := &HybridNode{
+		ReconNode:   MakeReconNode(pubkey, nil, interval, capacity),
+		FloodFanout: fanout,
+	}
+
+	for _, peer := range peers {
+		n.AddPeer(peer)
+	}
+
+	return n
+}
+
+// HybridNode relays gossip in the style of Erlay. New messages are flooded
+// to a small number of peers, which stand in for a node's outbound peers, and
+// are relayed to all other peers with set reconciliation. Since the channel
+// graph does not tell us which side opened a connection, the first
+// FloodFanout peers that are added to the node are used as flood peers.
+type HybridNode struct {
+	*ReconNode
+
+	// FloodFanout is the number of peers that new messages are flooded to.
+	FloodFanout int
+}
+
+// AddPeer adds a peer to the node, making it a flood peer if the node has
+// fewer than FloodFanout flood peers.
+func (n *HybridNode) AddPeer(peer string) {
+	n.ReconNode.AddPeer(peer)
+
+	if len(n.floodPeers) < n.FloodFanout {
+		n.floodPeers[peer] = true
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// invType indicates the purpose of an inventory control message.
+type invType int
+
+const (
+	// invAnnounce advertises to a peer that the sender has a message.
+	invAnnounce invType = iota
+
+	// invRequest asks a peer that announced a message to send it in full.
+	invRequest
+)
+
+// invMessage is a control message exchanged between InvNodes. It holds the
+// message that it refers to so that the receiver can read the message's ID
+// and timestamp, but only those two fields are considered to be sent over
+// the wire.
+type invMessage struct {
+	Message
+	kind invType
+}
+
+// invMessageSize is the size of an inventory message, which has a 2 byte
+// type, an 8 byte short channel ID and a 4 byte timestamp.
+const invMessageSize = 2 + 8 + 4
+
+// Size returns the size of the inventory message rather than the message it
+// refers to.
+func (i *invMessage) Size() int {
+	return invMessageSize
+}
+
+// pendingRequest is a request for a message that we have sent to a peer.
+type pendingRequest struct {
+	peer string
+	msg  Message
+}
+
+// MakeInvNode returns a node which relays gossip using an inventory based
+// protocol.
+func MakeInvNode(pubkey string, peers []string) Node {
+	return &InvNode{
+		Pubkey:         pubkey,
+		Peers:          peers,
+		RelayQueue:     make(map[string][]Message),
+		CachedMessages: make(map[string]Message),
+		pending:        make(map[string][]Message),
+		requested:      make(map[string]time.Time),
+		requestedFrom:  make(map[string]pendingRequest),
+		peerKnows:      make(map[string]map[string]time.Time),
+		disconnected:   make(map[string]bool),
+	}
+}
+
+// InvNode relays gossip by announcing the ID and timestamp of new messages
+// to its peers. Peers request the full message only if they do not already
+// have it (or a newer version of it), so full messages are never sent to a
+// peer more than once.
+//
+// Relaying a message over one hop takes three ticks: the announcement, the
+// request and the delivery of the full message.
+type InvNode struct {
+	// PubKey of the node being represented
+	Pubkey string
+
+	// Pubkeys of peers
+	Peers []string
+
+	// Queue of peer ID -> messages to send to peer this tick
+	RelayQueue map[string][]Message
+
+	// Map protocol ID to the most recent message we have for the ID
+	CachedMessages map[string]Message
+
+	// pending is the queue of peer ID -> messages produced while receiving
+	// messages, it becomes the relay queue when the queue is progressed.
+	pending map[string][]Message
+
+	// requested maps protocol ID to the timestamp of the message version we
+	// have requested, so that we do not request it from multiple peers.
+	requested map[string]time.Time
+
+	// requestedFrom maps protocol ID to the request we made for it, so
+	// that we can ask another peer if the connection to the peer drops.
+	requestedFrom map[string]pendingRequest
+
+	// peerKnows maps protocol ID to the peers that we know have the message
+	// and the timestamp of the most recent version they have.
+	peerKnows map[string]map[string]time.Time
+
+	// disconnected is the set of peers that we are not connected to, we
+	// do not announce messages to them or request messages from them.
+	disconnected map[string]bool
+
+	// filters holds the gossip_timestamp_filter each peer has sent us.
+	filters peerFilters
+
+	// RateLimiter decides whether we accept new messages from peers, all
+	// messages are accepted if it is nil.
+	RateLimiter RateLimiter
+
+	// Dependencies checks that new messages follow the announcements that
+	// they depend on, dependencies are not checked if it is nil.
+	Dependencies *Dependencies
+}
+
+func (n *InvNode) GetPubkey() string {
+	return n.Pubkey
+}
+
+func (n *InvNode) AddPeer(peer string) {
+	// do not add duplicate peers
+	for _, p := range n.Peers {
+		if p == peer {
+			return
+		}
+	}
+	n.Peers = append(n.Peers, peer)
+}
+
+func (n *InvNode) GetPeers() []string {
+	return n.Peers
+}
+
+func (n *InvNode) GetMessages() []Message {
+	messages := make([]Message, 0, len(n.CachedMessages))
+	for _, msg := range n.CachedMessages {
+		messages = append(messages, msg)
+	}
+	sortByID(messages)
+
+	return messages
+}
+
+// Holding always returns false because inventory nodes queue messages to be
+// sent on the very next tick.
+func (n *InvNode) Holding() bool {
+	return false
+}
+
+func (n *InvNode) GetQueue() map[string][]Message {
+	return n.RelayQueue
+}
+
+// ProgressQueue moves the messages queued while receiving messages this tick
+// into the relay queue so that they are sent in the next tick.
+func (n *InvNode) ProgressQueue() {
+	n.RelayQueue = n.pending
+	n.pending = make(map[string][]Message)
+}
+
+// ReceiveMessage handles announcements, requests and full messages from
+// peers. Only full messages are reported in the metrics store.
+func (n *InvNode) ReceiveMessage(dbc *labelledDB, msg Message, tick int, from string) error {
+	if filter, ok := msg.(*gossipTimestampFilter); ok {
+		n.SetPeerFilter(from, filter.filter)
+
+		backlog := filter.filter.backlog(n.GetMessages())
+		if len(backlog) > 0 {
+			n.pending[from] = append(n.pending[from], backlog...)
+		}
+		return nil
+	}
+
+	inv, ok := msg.(*invMessage)
+	if !ok {
+		return n.receiveFull(dbc, msg, tick, from)
+	}
+
+	switch inv.kind {
+	case invAnnounce:
+		n.receiveAnnouncement(inv.Message, from)
+
+	case invRequest:
+		n.receiveRequest(inv.Message, from)
+	}
+
+	return nil
+}
+
+// receiveFull caches a full message and announces it to all of the peers
+// that are not known to have it already if it is new to us.
+func (n *InvNode) receiveFull(dbc *labelledDB, msg Message, tick int, from string) error {
+	cached, ok := n.CachedMessages[msg.ID()]
+	isNew := !ok || cached.TimeStamp().Before(msg.TimeStamp())
+
+	// new messages must follow their dependencies and pass our rate limit
+	// before we accept them, if a message is dropped or deferred we may
+	// request it again when it is announced
+	if isNew {
+		ok, err := n.Dependencies.check(dbc, msg, n.Pubkey, tick, from)
+		if err == nil && ok {
+			ok, err = admit(dbc, n.RateLimiter, msg, n.Pubkey, tick,
+				from)
+		}
+		if err != nil || !ok {
+			delete(n.requested, msg.ID())
+			delete(n.requestedFrom, msg.ID())
+			return err
+		}
+	}
+
+	if err := ReportMessage(dbc, msg, n.Pubkey, tick); err != nil {
+		return err
+	}
+
+	n.markKnown(msg, from)
+
+	// do nothing if we already have this message or a newer one
+	if !isNew {
+		return nil
+	}
+	n.CachedMessages[msg.ID()] = msg
+
+	// if we were waiting on this version (or an older one) of the message,
+	// the request has been fulfilled
+	if ts, ok := n.requested[msg.ID()]; ok && !ts.After(msg.TimeStamp()) {
+		delete(n.requested, msg.ID())
+		delete(n.requestedFrom, msg.ID())
+	}
+
+	for _, peer := range n.Peers {
+		if n.peerHas(msg, peer) || !n.filters.allows(n.Pubkey, peer, msg) ||
+			n.disconnected[peer] {
+
+			continue
+		}
+
+		n.pending[peer] = append(n.pending[peer], &invMessage{
+			Message: msg,
+			kind:    invAnnounce,
+		})
+	}
+
+	// process any messages that were waiting on this one
+	for _, deferred := range n.Dependencies.learn(msg) {
+		err := n.receiveFull(dbc, deferred.msg, tick, deferred.from)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// receiveAnnouncement requests an announced message from the announcing peer
+// if we do not have it and have not already requested it from another peer.
+func (n *InvNode) receiveAnnouncement(msg Message, from string) {
+	n.markKnown(msg, from)
+
+	if cached, ok := n.CachedMessages[msg.ID()]; ok &&
+		!cached.TimeStamp().Before(msg.TimeStamp()) {
+		return
+	}
+
+	if ts, ok := n.requested[msg.ID()]; ok && !ts.Before(msg.TimeStamp()) {
+		return
+	}
+
+	n.request(msg, from)
+}
+
+// request asks a peer for the full version of a message.
+func (n *InvNode) request(msg Message, peer string) {
+	n.requested[msg.ID()] = msg.TimeStamp()
+	n.requestedFrom[msg.ID()] = pendingRequest{
+		peer: peer,
+		msg:  msg,
+	}
+
+	n.pending[peer] = append(n.pending[peer], &invMessage{
+		Message: msg,
+		kind:    invRequest,
+	})
+}
+
+// PeerDisconnected moves the requests we made to a peer to another peer that
+// has announced the message, or forgets them so that we request the message
+// when it is next announced.
+func (n *InvNode) PeerDisconnected(peer string) {
+	n.disconnected[peer] = true
+
+	var ids []string
+	for id, req := range n.requestedFrom {
+		if req.peer == peer {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		msg := n.requestedFrom[id].msg
+		delete(n.requested, id)
+		delete(n.requestedFrom, id)
+
+		for _, other := range n.Peers {
+			if n.disconnected[other] || !n.peerHas(msg, other) {
+				continue
+			}
+
+			n.request(msg, other)
+			break
+		}
+	}
+}
+
+// PeerConnected lets us announce messages to and request messages from a
+// peer again.
+func (n *InvNode) PeerConnected(peer string) {
+	delete(n.disconnected, peer)
+}
+
+// receiveRequest sends the most recent version of a requested message to the
+// requesting peer.
+func (n *InvNode) receiveRequest(msg Message, from string) {
+	cached, ok := n.CachedMessages[msg.ID()]
+	if !ok {
+		return
+	}
+
+	n.markKnown(cached, from)
+	n.pending[from] = append(n.pending[from], cached)
+}
+
+// SendTimestampFilter queues a gossip_timestamp_filter for a peer.
+func (n *InvNode) SendTimestampFilter(peer string, filter TimestampFilter) {
+	n.pending[peer] = append(n.pending[peer], &gossipTimestampFilter{
+		filter: filter,
+	})
+}
+
+// SetPeerFilter sets the filter we apply to messages we announce to a peer.
+func (n *InvNode) SetPeerFilter(peer string, filter TimestampFilter) {
+	if n.filters == nil {
+		n.filters = make(peerFilters)
+	}
+
+	n.filters[peer] = filter
+}
+
+// SetRateLimiter sets the limiter used for new messages from peers.
+func (n *InvNode) SetRateLimiter(limiter RateLimiter) {
+	n.RateLimiter = limiter
+}
+
+// SetDependencies sets the tracker used to check the dependencies of new
+// messages from peers.
+func (n *InvNode) SetDependencies(deps *Dependencies) {
+	n.Dependencies = deps
+}
+
+// GetDependencies returns the node's dependency tracker.
+func (n *InvNode) GetDependencies() *Dependencies {
+	return n.Dependencies
+}
+
+// markKnown records that peer has a message.
+func (n *InvNode) markKnown(msg Message, peer string) {
+	known, ok := n.peerKnows[msg.ID()]
+	if !ok {
+		known = make(map[string]time.Time)
+		n.peerKnows[msg.ID()] = known
+	}
+
+	if ts, ok := known[peer]; !ok || ts.Before(msg.TimeStamp()) {
+		known[peer] = msg.TimeStamp()
+	}
+}
+
+// peerHas returns true if peer is known to have the message or a newer
+// version of it.
+func (n *InvNode) peerHas(msg Message, peer string) bool {
+	ts, ok := n.peerKnows[msg.ID()][peer]
+	return ok && !ts.Before(msg.TimeStamp())
+}
@@ -0,0 +1,493 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+var wirewatcher = flag.String("wirewatcher_db",
+	"mysql://root@unix("+SockFile+")/wirewatcher?",
+	"uri for wirewatcher DB")
+
+// loaderPageSize is the number of rows read with each query, so that no
+// query is held open while the simulation runs.
+const loaderPageSize = 10000
+
+// Queries for each message type, joined with ln_messages for the size of the
+// message. Each query reads a page of the messages in a range of timestamps
+// in timestamp order, messages with the same timestamp are ordered by uuid so
+// that they are released in the same order in every run. The %v is replaced
+// with a keyset condition when reading pages after the first, which starts
+// the page after the last row read.
+const (
+	channelAnnouncementQuery = "select a.uuid, a.chan_id, a.node_1, " +
+		"a.node_2, a.`timestamp`, m.byte_len from channel_announcements a " +
+		"join ln_messages m on m.uuid=a.uuid where a.`timestamp`>=? and " +
+		"a.`timestamp`<?%v order by a.`timestamp`, a.uuid limit ?"
+
+	nodeAnnouncementQuery = "select n.uuid, n.node_id, n.`timestamp`, " +
+		"n.alias, n.addresses, m.byte_len from node_announcements n " +
+		"join ln_messages m on m.uuid=n.uuid where n.`timestamp`>=? and " +
+		"n.`timestamp`<?%v order by n.`timestamp`, n.uuid limit ?"
+
+	// channelUpdateQuery also joins each update with the nodes of its
+	// channel, from any announcement we have for the channel.
+	channelUpdateQuery = "select u.uuid, u.chan_id, u.`timestamp`, " +
+		"u.base_fee, u.fee_rate, u.channel_flags, u.message_flags, " +
+		"u.max_htlc, u.min_htlc, u.timelock_delta, m.byte_len, a.node_1, " +
+		"a.node_2 from " +
+		"channel_updates u join ln_messages m on m.uuid=u.uuid left join " +
+		"(select chan_id, min(node_1) as node_1, min(node_2) as node_2 " +
+		"from channel_announcements group by chan_id) a on " +
+		"a.chan_id=u.chan_id where u.`timestamp`>=? and u.`timestamp`<?%v " +
+		"order by u.`timestamp`, u.uuid limit ?"
+)
+
+// position is the place of a row in the order that rows are read in.
+type position struct {
+	ts   time.Time
+	uuid int64
+}
+
+// row is an item read from a row source, along with its position.
+type row struct {
+	item interface{}
+	pos  position
+}
+
+// rowSource reads the rows of one message type in timestamp and uuid order.
+type rowSource interface {
+	// readRows returns up to limit rows with timestamps in [start, end).
+	// If after is not nil, only rows after it are returned.
+	readRows(start, end time.Time, after *position, limit int) ([]row,
+		error)
+}
+
+// queryRows is a row source which reads rows from the wirewatcher DB. Each
+// call runs its own query, so no query stays open between calls.
+type queryRows struct {
+	dbc *sql.DB
+
+	// query is one of the message queries, and table is the alias of the
+	// table whose timestamp and uuid the rows are ordered by.
+	query string
+	table string
+
+	// scan reads the current row into an item and returns its position.
+	scan func(rows *sql.Rows) (interface{}, position, error)
+}
+
+func (q *queryRows) readRows(start, end time.Time, after *position,
+	limit int) ([]row, error) {
+
+	args := []interface{}{start, end}
+
+	var keyset string
+	if after != nil {
+		keyset = fmt.Sprintf(" and (%[1]v.`timestamp`>? or "+
+			"(%[1]v.`timestamp`=? and %[1]v.uuid>?))", q.table)
+		args = append(args, after.ts, after.ts, after.uuid)
+	}
+	args = append(args, limit)
+
+	rows, err := q.dbc.Query(fmt.Sprintf(q.query, keyset), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var read []row
+	for rows.Next() {
+		item, pos, err := q.scan(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		read = append(read, row{item: item, pos: pos})
+	}
+
+	return read, rows.Err()
+}
+
+// cursor reads the rows of a source one bucket at a time, paging through
+// the rows of each bucket so that no query reads too many rows at once.
+type cursor struct {
+	source   rowSource
+	pageSize int
+
+	// from is the start of the rows that have not been read yet, and end
+	// is the end of the time window, which is not included.
+	from time.Time
+	end  time.Time
+}
+
+func newCursor(source rowSource, startTime, endTime time.Time,
+	pageSize int) *cursor {
+
+	return &cursor{
+		source:   source,
+		pageSize: pageSize,
+		from:     startTime,
+		end:      endTime,
+	}
+}
+
+// readUntil returns the items with timestamps before the end time provided
+// that have not been read yet.
+func (c *cursor) readUntil(end time.Time) ([]interface{}, error) {
+	if end.After(c.end) {
+		end = c.end
+	}
+
+	if !end.After(c.from) {
+		return nil, nil
+	}
+
+	var (
+		items []interface{}
+		after *position
+	)
+	for {
+		rows, err := c.source.readRows(c.from, end, after, c.pageSize)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, r := range rows {
+			items = append(items, r.item)
+		}
+
+		// a short page is the last page of the range
+		if len(rows) < c.pageSize {
+			break
+		}
+		after = &rows[len(rows)-1].pos
+	}
+	c.from = end
+
+	return items, nil
+}
+
+// streamingManager reads messages from the wirewatcher DB one bucket at a
+// time, as they are requested, so that memory use does not grow with the
+// length of the time window. It only needs to keep the state used to find
+// duplicates, which grows with the number of channels and nodes.
+type streamingManager struct {
+	startTime  time.Time
+	tick       time.Duration
+	lastBucket int
+	dedup      DedupStrategy
+
+	// dedupCounts counts the updates that every dedup strategy removes,
+	// not just the one used.
+	dedupCounts *dedupCounts
+
+	channelAnnouncements *cursor
+	nodeAnnouncements    *cursor
+	updates              *cursor
+
+	// dbc is the connection to the wirewatcher DB, it is nil if messages
+	// are not read from the DB.
+	dbc *sql.DB
+
+	// announced holds the channels we have read an announcement for, so
+	// that we only release the first announcement for each channel.
+	announced map[string]bool
+
+	// nodeVersions holds the timestamp of the last announcement we have
+	// read for each node, so that we only release each version once.
+	nodeVersions map[string]time.Time
+
+	// nextBucket is the next bucket to be read.
+	nextBucket int
+
+	// closed is set once all of the messages have been read.
+	closed bool
+
+	// counts of the updates read, the updates that the dedup strategy
+	// removed, the updates for channels with no announcement and the
+	// updates released that disable their channel.
+	updateCount, removedCount, unannouncedCount, disabledCount int
+
+	err error
+}
+
+// NewFloodMessageManager returns a message manager which streams the
+// messages from the start time up to the end of the duration from the
+// wirewatcher DB, one tick at a time. Duplicate channel updates are removed
+// with the dedup strategy provided.
+func NewFloodMessageManager(startTime time.Time, duration, tick time.Duration,
+	dedup DedupStrategy) (*streamingManager, error) {
+
+	dbc, err := connectWithURI(*wirewatcher)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := newStreamingManager(startTime, duration, tick, dedup,
+		&queryRows{
+			dbc:   dbc,
+			query: channelAnnouncementQuery,
+			table: "a",
+			scan:  scanChannelAnnouncement,
+		},
+		&queryRows{
+			dbc:   dbc,
+			query: nodeAnnouncementQuery,
+			table: "n",
+			scan:  scanNodeAnnouncement,
+		},
+		&queryRows{
+			dbc:   dbc,
+			query: channelUpdateQuery,
+			table: "u",
+			scan:  scanChannelUpdate,
+		},
+	)
+	if err != nil {
+		dbc.Close()
+		return nil, err
+	}
+	m.dbc = dbc
+
+	return m, nil
+}
+
+// newStreamingManager returns a message manager which streams the messages
+// from the start time up to the end of the duration from the row sources
+// for each message type.
+func newStreamingManager(startTime time.Time, duration, tick time.Duration,
+	dedup DedupStrategy, channelAnnouncements, nodeAnnouncements,
+	updates rowSource) (*streamingManager, error) {
+
+	counts, err := newDedupCounts(*dedupWindow, startTime, tick)
+	if err != nil {
+		return nil, err
+	}
+
+	// the window does not include its end time, so if it ends at the
+	// start of a bucket the previous bucket is the last one
+	endTime := startTime.Add(duration)
+	lastBucket := bucketIndex(endTime, startTime, tick)
+	if lastBucket > 0 &&
+		!startTime.Add(time.Duration(lastBucket)*tick).Before(endTime) {
+
+		lastBucket--
+	}
+
+	return &streamingManager{
+		startTime:  startTime,
+		tick:       tick,
+		lastBucket: lastBucket,
+		dedup:      dedup,
+		channelAnnouncements: newCursor(channelAnnouncements, startTime,
+			endTime, loaderPageSize),
+		nodeAnnouncements: newCursor(nodeAnnouncements, startTime,
+			endTime, loaderPageSize),
+		updates: newCursor(updates, startTime, endTime,
+			loaderPageSize),
+		dedupCounts:  counts,
+		announced:    make(map[string]bool),
+		nodeVersions: make(map[string]time.Time),
+	}, nil
+}
+
+// GetNewMessages reads the messages for a tick from the DB. Ticks must be
+// requested in order, the messages for any ticks that are skipped are
+// discarded. If reading fails, no more messages are returned and the error
+// is available from Err.
+func (m *streamingManager) GetNewMessages(tick int) ([]Message, bool) {
+	if m.err != nil || m.closed {
+		return nil, true
+	}
+
+	var messages []Message
+	for ; m.nextBucket <= tick; m.nextBucket++ {
+		end := m.startTime.Add(time.Duration(m.nextBucket+1) * m.tick)
+
+		var err error
+		messages, err = m.readBucket(end)
+		if err != nil {
+			log.Printf("Could not read messages for tick %v: %v",
+				m.nextBucket, err)
+
+			m.err = err
+			m.close()
+			return nil, true
+		}
+	}
+
+	done := tick >= m.lastBucket
+	if done {
+		log.Printf("Read in %v unique updates from %v updates, %v dedup "+
+			"removed %v, %v had no channel announcement, %v disable "+
+			"their channel",
+			m.updateCount-m.removedCount-m.unannouncedCount,
+			m.updateCount, m.dedup, m.removedCount, m.unannouncedCount,
+			m.disabledCount)
+		m.dedupCounts.log(m.updateCount)
+
+		m.close()
+	}
+
+	return messages, done
+}
+
+// StartTime returns the time that the first tick starts at.
+func (m *streamingManager) StartTime() time.Time {
+	return m.startTime
+}
+
+// Err returns the error that stopped messages from being read, if any.
+func (m *streamingManager) Err() error {
+	return m.err
+}
+
+// readBucket reads the messages with timestamps before the end of a bucket.
+// Announcements are returned before updates so that new channels are
+// announced before any updates for them in a bucket.
+func (m *streamingManager) readBucket(end time.Time) ([]Message, error) {
+	var messages []Message
+
+	items, err := m.channelAnnouncements.readUntil(end)
+	if err != nil {
+		return nil, err
+	}
+
+	// the dataset records an announcement each time it is received from a
+	// peer, so only the first announcement for each channel is used
+	for _, item := range items {
+		msg := item.(*ChannelAnnouncement)
+		if m.announced[msg.chanID] {
+			continue
+		}
+		m.announced[msg.chanID] = true
+
+		messages = append(messages, msg)
+	}
+
+	items, err = m.nodeAnnouncements.readUntil(end)
+	if err != nil {
+		return nil, err
+	}
+
+	// each version of a node's announcement is only used once, even if it
+	// was received from multiple peers
+	for _, item := range items {
+		msg := item.(*NodeAnnouncement)
+		if ts, ok := m.nodeVersions[msg.Node]; ok && ts.Equal(msg.ts) {
+			continue
+		}
+		m.nodeVersions[msg.Node] = msg.ts
+
+		messages = append(messages, msg)
+	}
+
+	items, err = m.updates.readUntil(end)
+	if err != nil {
+		return nil, err
+	}
+
+	updates := make([]dbChanUpdate, 0, len(items))
+	for _, item := range items {
+		updates = append(updates, item.(dbChanUpdate))
+	}
+	m.updateCount += len(updates)
+
+	unique := m.dedup.Filter(updates)
+	m.removedCount += len(updates) - len(unique)
+	m.dedupCounts.add(updates)
+
+	for _, update := range unique {
+		// we can reasonably expect that we do not have the announcement
+		// for very old channels, so just skip the update
+		if update.node1 == "" {
+			m.unannouncedCount++
+			continue
+		}
+
+		msg := newChannelUpdate(update)
+		if msg.Disabled {
+			m.disabledCount++
+		}
+
+		messages = append(messages, msg)
+	}
+
+	return messages, nil
+}
+
+// newChannelUpdate returns the message for an update read from the DB. The
+// update comes from the node that the direction bit of its channel_flags
+// points to, regardless of the other flags set.
+func newChannelUpdate(update dbChanUpdate) *ChannelUpdate {
+	msg := &ChannelUpdate{
+		id:      update.id,
+		Node:    update.node1,
+		ts:      update.ts,
+		chanID:  update.chanID,
+		byteLen: update.byteLen,
+	}
+	msg.setFlags(update.chanFlags, update.msgFlags)
+
+	if msg.Direction == 1 {
+		msg.Node = update.node2
+	}
+
+	return msg
+}
+
+// close releases the manager's DB connection, it may be called more than
+// once.
+func (m *streamingManager) close() {
+	if m.closed {
+		return
+	}
+
+	m.closed = true
+	if m.dbc != nil {
+		m.dbc.Close()
+	}
+}
+
+func scanChannelAnnouncement(rows *sql.Rows) (interface{}, position, error) {
+	var msg ChannelAnnouncement
+	err := rows.Scan(&msg.id, &msg.chanID, &msg.Node1, &msg.Node2, &msg.ts,
+		&msg.byteLen)
+
+	return &msg, position{ts: msg.ts, uuid: msg.id}, err
+}
+
+func scanNodeAnnouncement(rows *sql.Rows) (interface{}, position, error) {
+	var (
+		msg       NodeAnnouncement
+		addresses string
+	)
+	err := rows.Scan(&msg.id, &msg.Node, &msg.ts, &msg.Alias, &addresses,
+		&msg.byteLen)
+
+	if addresses != "" {
+		msg.Addresses = strings.Split(addresses, ",")
+	}
+
+	return &msg, position{ts: msg.ts, uuid: msg.id}, err
+}
+
+func scanChannelUpdate(rows *sql.Rows) (interface{}, position, error) {
+	var (
+		update       dbChanUpdate
+		node1, node2 sql.NullString
+	)
+	err := rows.Scan(&update.id, &update.chanID, &update.ts,
+		&update.baseFee, &update.feeRate, &update.chanFlags,
+		&update.msgFlags, &update.maxHTLC, &update.minHTLC, &update.timeLock,
+		&update.byteLen, &node1, &node2)
+
+	update.node1, update.node2 = node1.String, node2.String
+
+	return update, position{ts: update.ts, uuid: update.id}, err
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
+	"strings"
 	"time"
 )
 
@@ -18,35 +20,138 @@ var (
 
 	duration = flag.Int("duration_minutes", 60,
 		"amount of messages to load (specified in time)")
+
+	tickSeconds = flag.Float64("tick_seconds", 90,
+		"number of seconds each tick represents, messages are released "+
+			"in the tick that their timestamp falls in")
+
+	seed = flag.Int64("seed", 0,
+		"seed for the order that nodes send messages in and random "+
+			"choices made by relay protocols, link delays, anti-entropy "+
+			"and synthetic workloads, runs with the same seed and "+
+			"messages produce the same results")
+
+	workload = flag.String("workload", "db",
+		"source of messages to simulate: db reads messages from the "+
+			"wirewatcher DB, file reads them from message_file and "+
+			"synthetic generates them for the graph")
+
+	messageFile = flag.String("message_file", "",
+		"path to a JSON lines or CSV (.csv) message file to read "+
+			"messages from")
+
+	exportPath = flag.String("export_path", "",
+		"if set, messages are read from the wirewatcher DB and written "+
+			"to this path as JSON lines or CSV (.csv) instead of running "+
+			"a simulation")
+
+	antiEntropyInterval = flag.Duration("anti_entropy_interval", 0,
+		"time between anti-entropy rounds (0 disables anti-entropy)")
+
+	antiEntropyPairs = flag.Int("anti_entropy_pairs", 10,
+		"number of random peer pairs that are fully synced in each "+
+			"anti-entropy round")
+
+	antiEntropyRounds = flag.Int("anti_entropy_rounds", 0,
+		"maximum number of anti-entropy rounds run once relaying has "+
+			"settled (0 runs rounds until every node is in sync with "+
+			"its peers)")
 )
 
 func main() {
 	flag.Parse()
 
+	startTime, err := time.Parse("2006-01-02 15:04:05", *startTime)
+	if err != nil {
+		log.Fatalf("cannot parse time: %v", err)
+	}
+	duration := time.Minute * time.Duration(*duration)
+
+	tick := tickDuration()
+	if tick <= 0 {
+		log.Fatalf("tick duration must be positive, got: %v", tick)
+	}
+
+	dedup, err := ParseDedupStrategy(*dedupStrategy, *dedupWindow, startTime,
+		tick)
+	if err != nil {
+		log.Fatalf("cannot load messages: %v", err)
+	}
+
+	if *exportPath != "" {
+		err := ExportMessages(*exportPath, startTime, duration, tick,
+			dedup)
+		if err != nil {
+			log.Fatalf("could not export messages: %v", err)
+		}
+		return
+	}
+
 	dbc, err := Connect(*dbLabel)
 	if err != nil {
 		log.Fatalf("could not connect to DB: %v", err)
 	}
 
+	log.Printf("Running simulation %v with seed %v", *dbLabel, *seed)
+	if err := WriteRun(dbc, *seed, runConfig()); err != nil {
+		log.Fatalf("could not record run: %v", err)
+	}
+
+	makeNode, err := nodeMaker(*protocol)
+	if err != nil {
+		log.Fatalf("cannot create nodes: %v", err)
+	}
+
+	depMode, err := ParseDependencyMode(*dependencyMode)
+	if err != nil {
+		log.Fatalf("cannot create nodes: %v", err)
+	}
+
 	log.Println("Reading in channel graph")
-	nodes, err := readChanGraph()
+	nodes, channels, err := readChanGraph(makeNode)
 	if err != nil {
 		log.Fatalf("cannot parse channel graph: %v", err)
 	}
 
-	startTime, err := time.Parse("2006-01-02 15:04:05", *startTime)
-	if err != nil {
-		log.Fatalf("cannot parse time: %v", err)
+	if depMode != DependenciesOff {
+		applyDependencies(nodes, depMode, channels)
+	}
+
+	if *filterActivePeers >= 0 {
+		applyTimestampFilters(nodes, *filterActivePeers)
 	}
 
 	log.Println("Reading in messages")
-	duration := time.Duration(*duration)
-	mgr, err := NewFloodMessageManager(startTime, time.Minute*duration)
-	if err != nil {
-		log.Fatalf("could not load messages: %v", err)
+
+	var mgr MessageManager
+	switch *workload {
+	case "db":
+		mgr, err = NewFloodMessageManager(startTime, duration, tick,
+			dedup)
+		if err != nil {
+			log.Fatalf("could not load messages: %v", err)
+		}
+
+	case "file":
+		mgr, err = NewFileMessageManager(*messageFile, tick)
+		if err != nil {
+			log.Fatalf("could not load messages: %v", err)
+		}
+
+	case "synthetic":
+		mgr = NewSyntheticMessageManager(channels,
+			syntheticConfig(startTime, duration, tick))
+
+	default:
+		log.Fatalf("unknown workload: %v", *workload)
 	}
 
-	simulate(dbc, mgr, nodes)
+	resolution := simulate(dbc, mgr, nodes, channels)
+
+	// messages streamed from the DB may fail to load during the simulation
+	if streaming, ok := mgr.(*streamingManager); ok && streaming.Err() != nil {
+		log.Fatalf("could not load messages: %v", streaming.Err())
+	}
 
 	// print out latency and duplicate summaries for nodes.
 	summaries, err := GetSummary(dbc)
@@ -54,24 +159,90 @@ func main() {
 		log.Fatalf("could not get summary: %v", err)
 	}
 	for _, s := range summaries {
-		s.print()
+		s.print(resolution)
+	}
+}
+
+// runConfig returns the flags that were set for this run, as space separated
+// name=value pairs in name order.
+func runConfig() string {
+	var config []string
+	flag.Visit(func(f *flag.Flag) {
+		config = append(config, fmt.Sprintf("%v=%v", f.Name,
+			f.Value.String()))
+	})
+
+	return strings.Join(config, " ")
+}
+
+// tickDuration returns the amount of time that each tick represents.
+func tickDuration() time.Duration {
+	return time.Duration(*tickSeconds * float64(time.Second))
+}
+
+// stepDuration returns the amount of time that each tick nodes are given
+// represents, which is a step in the event engine.
+func stepDuration() time.Duration {
+	if *engine == "event" {
+		return *eventStep
+	}
+
+	return tickDuration()
+}
+
+// durationTicks returns the number of ticks nodes are given that a duration
+// spans, rounded up so that a positive duration always spans at least one.
+func durationTicks(d time.Duration) int {
+	tick := stepDuration()
+
+	ticks := int(d / tick)
+	if time.Duration(ticks)*tick < d {
+		ticks++
 	}
+
+	return ticks
 }
 
-func simulate(dbc *labelledDB, mMgr MessageManager, nodes map[string]Node) {
+// hourlyPerTick converts a rate per hour into a rate per tick nodes are
+// given.
+func hourlyPerTick(rate float64) float64 {
+	return rate * stepDuration().Hours()
+}
+
+// simulate runs the engine set by flags until all messages have been
+// relayed, and returns the amount of time each tick recorded in the metrics
+// represents. The channel graph is used to set link delays, and may be nil
+// if they are not derived from node addresses.
+func simulate(dbc *labelledDB, mMgr MessageManager, nodes map[string]Node,
+	graph *GraphChannels) time.Duration {
+
 	start := time.Now()
 	log.Printf("Stating simulation at %v", start)
-	chanGraph := NewChannelGraph(nodes)
+	sim, resolution, err := newEngine(nodes, graph)
+	if err != nil {
+		log.Fatalf("cannot create engine: %v", err)
+	}
 
 	// track the number of peers that we could not find in the chan graph
 	// to relay messages to and the number of nodes we could not find in
 	// the graph that have messages originating from them in the dataset
 	var unknownPeers, knownPeers, unknownNodes, knownNodes int
 
+	// track the cost and benefit of anti-entropy repairs
+	var repairDigestEntries, repaired, repairBytes int
+
+	// track the nodes that went offline, and how far behind they were when
+	// they came back online
+	var offline, online, stale, unsynced, offlineDropped int
+
+	// track the total bytes sent between peers
+	var bytesSent int
+
 	// get the new messages for this tick and send them to their origin
 	// nodes to simulate creation of messages.
+	var ticks int
 	for {
-		result, err := chanGraph.Tick(dbc, mMgr)
+		result, err := sim.Tick(dbc, mMgr)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -80,6 +251,22 @@ func simulate(dbc *labelledDB, mMgr MessageManager, nodes map[string]Node) {
 		knownPeers += result.peerKnown
 		unknownNodes += result.nodeUnknown
 		knownNodes += result.nodesKnown
+		bytesSent += result.bytesSent
+		ticks = result.tickCount
+
+		if result.repair != nil {
+			repairDigestEntries += result.repair.digestEntries
+			repaired += result.repair.repaired
+			repairBytes += result.repair.bytes
+		}
+
+		if result.churn != nil {
+			offline += result.churn.offline
+			online += result.churn.online
+			stale += result.churn.stale
+			unsynced += result.churn.unsynced
+			offlineDropped += result.churn.dropped
+		}
 
 		if result.done {
 			break
@@ -87,7 +274,32 @@ func simulate(dbc *labelledDB, mMgr MessageManager, nodes map[string]Node) {
 	}
 
 	log.Printf("Ending simulation at %v, Runtime: %v, unknown peers: %v, "+
-		"unknown nodes: %v", time.Now(), time.Now().Sub(start),
+		"unknown nodes: %v, bytes sent: %v", time.Now(),
+		time.Now().Sub(start),
 		float32(unknownPeers)/float32(knownPeers+unknownPeers),
-		float32(unknownNodes)/float32(knownNodes+unknownNodes))
+		float32(unknownNodes)/float32(knownNodes+unknownNodes), bytesSent)
+
+	log.Printf("Simulated %v ticks of %v (%v)", ticks, resolution,
+		time.Duration(ticks)*resolution)
+
+	if *antiEntropyInterval > 0 {
+		log.Printf("Anti-entropy exchanged %v digest entries and repaired "+
+			"%v messages, sending %v bytes", repairDigestEntries,
+			repaired, repairBytes)
+	}
+
+	if offline > 0 {
+		log.Printf("Nodes went offline %v times and came back online %v "+
+			"times, missing %v messages, %v could not sync and %v "+
+			"gossip messages were dropped while nodes were offline",
+			offline, online, stale, unsynced, offlineDropped)
+	}
+
+	rejected, deferred, pending := dependencyTotals(nodes)
+	if rejected+deferred > 0 {
+		log.Printf("Messages with missing dependencies: %v rejected, %v "+
+			"deferred, %v still waiting", rejected, deferred, pending)
+	}
+
+	return resolution
 }
@@ -1,7 +1,16 @@
 package main
 
 import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
 )
 
 func TestSimulate(t *testing.T) {
@@ -149,20 +158,2392 @@ func TestSimulate(t *testing.T) {
 				}
 			},
 		},
-	}
 
-	for _, test := range tests {
-		t.Run(test.name, func(t *testing.T) {
-			dbc := connectAndResetForTesting(t)
+		{
+			name: "Inventory linear nodes",
+			// A ---- B ---- C
+			nodes: map[string]Node{
+				nodeA: MakeInvNode(nodeA, []string{nodeB}),
+				nodeB: MakeInvNode(nodeB, []string{nodeA, nodeC}),
+				nodeC: MakeInvNode(nodeC, []string{nodeB}),
+			},
+			// Tick 0: A(M1*)
+			// Tick 1: B(a.inv(M1))
+			// Tick 2: A(b.req(M1))
+			// Tick 3: B(a.M1)
+			// Tick 4: C(b.inv(M1)), B knows that A has M1 so it
+			//         does not announce it to A
+			// Tick 5: B(c.req(M1))
+			// Tick 6: C(b.M1)
+			messages: map[int][]Message{
+				0: {
+					&ChannelUpdate{id: 1, Node: nodeA, chanID: "chan1"},
+				},
+			},
+			checkResults: func(t *testing.T, dbc *labelledDB) {
+				count, err := GetDuplicateCount(dbc, 1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if count != 0 {
+					t.Fatalf("Expected have no duplicates, got: %v", count)
+				}
 
-			mMgr := &floodManager{
-				messages:   test.messages,
-				lastBucket: len(test.messages),
-			}
+				latency, err := GetMessageLatency(dbc, 1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if latency != 6 {
+					t.Fatalf("Expected latency: %v, got %v", 6, latency)
+				}
+			},
+		},
 
-			simulate(dbc, mMgr, test.nodes)
+		{
+			name: "Inventory circular simulation",
+			// A ---- B
+			// |      |
+			// D ---- C
+			nodes: map[string]Node{
+				nodeA: MakeInvNode(nodeA, []string{nodeB, nodeD}),
+				nodeB: MakeInvNode(nodeB, []string{nodeA, nodeC}),
+				nodeC: MakeInvNode(nodeC, []string{nodeB, nodeD}),
+				nodeD: MakeInvNode(nodeD, []string{nodeA, nodeC}),
+			},
+			// Tick 0: A(M1*)
+			// Tick 3: B(a.M1) D(a.M1)
+			// Tick 4: C(b.inv(M1), d.inv(M1)), C only requests M1 once
+			// Tick 6: C(b.M1) or C(d.M1)
+			messages: map[int][]Message{
+				0: {
+					&ChannelUpdate{id: 1, Node: nodeA, chanID: "chan1"},
+				},
+			},
+			checkResults: func(t *testing.T, dbc *labelledDB) {
+				count, err := GetDuplicateCount(dbc, 1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if count != 0 {
+					t.Fatalf("Expected C to receive no duplicates, got: %v", count)
+				}
 
-			test.checkResults(t, dbc)
-		})
-	}
+				latency, err := GetMessageLatency(dbc, 1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if latency != 6 {
+					t.Fatalf("Expected latency: %v, got %v", 6, latency)
+				}
+			},
+		},
+
+		{
+			name: "Reconciliation linear nodes",
+			// A ---- B ---- C
+			nodes: map[string]Node{
+				nodeA: MakeReconNode(nodeA, []string{nodeB}, 1, ErlayCapacity(0)),
+				nodeB: MakeReconNode(nodeB, []string{nodeA, nodeC}, 1, ErlayCapacity(0)),
+				nodeC: MakeReconNode(nodeC, []string{nodeB}, 1, ErlayCapacity(0)),
+			},
+			// Tick 0: A(M1*)
+			// Tick 1: B(a.req)
+			// Tick 2: A(b.sketch)
+			// Tick 3: B(a.M1, a.resp)
+			// Tick 4: C(b.req)
+			// Tick 5: B(c.sketch)
+			// Tick 6: C(b.M1, b.resp)
+			messages: map[int][]Message{
+				0: {
+					&ChannelUpdate{id: 1, Node: nodeA, chanID: "chan1"},
+				},
+			},
+			checkResults: func(t *testing.T, dbc *labelledDB) {
+				count, err := GetDuplicateCount(dbc, 1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if count != 0 {
+					t.Fatalf("Expected have no duplicates, got: %v", count)
+				}
+
+				latency, err := GetMessageLatency(dbc, 1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if latency != 6 {
+					t.Fatalf("Expected latency: %v, got %v", 6, latency)
+				}
+			},
+		},
+
+		{
+			name: "Reconciliation shared messages",
+			// A ---- B
+			// Sets are the same size, so q must be large enough for the
+			// sketch to have capacity for both differences.
+			nodes: map[string]Node{
+				nodeA: MakeReconNode(nodeA, []string{nodeB}, 1, ErlayCapacity(1)),
+				nodeB: MakeReconNode(nodeB, []string{nodeA}, 1, ErlayCapacity(1)),
+			},
+			// Tick 0: A(M1*, M2*) B(M2*, M3*)
+			// Tick 1: B(a.req), A ignores B's request because it has
+			//		   the lower pubkey
+			// Tick 2: A(b.sketch), decodes {M1, M3}
+			// Tick 3: B(a.M1, a.resp(M3))
+			// Tick 4: A(b.M3)
+			messages: map[int][]Message{
+				0: {
+					&ChannelUpdate{id: 1, Node: nodeA, chanID: "chan1"},
+					&ChannelUpdate{id: 2, Node: nodeA, chanID: "chan2"},
+					&ChannelUpdate{id: 2, Node: nodeB, chanID: "chan2"},
+					&ChannelUpdate{id: 3, Node: nodeB, chanID: "chan3"},
+				},
+			},
+			checkResults: func(t *testing.T, dbc *labelledDB) {
+				for i := 1; i < 4; i++ {
+					count, err := GetDuplicateCount(dbc, int64(i))
+					if err != nil {
+						t.Fatal(err)
+					}
+					if count != 0 {
+						t.Fatalf("Expected have no duplicates, got: %v", count)
+					}
+				}
+
+				latency, err := GetMessageLatency(dbc, 3)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if latency != 4 {
+					t.Fatalf("Expected latency: %v, got %v", 4, latency)
+				}
+			},
+		},
+
+		{
+			name: "Hybrid linear nodes",
+			// A ---- B ---- C
+			// Each node floods to its first peer, so A and B flood to
+			// each other and B reconciles with C.
+			nodes: map[string]Node{
+				nodeA: MakeHybridNode(nodeA, []string{nodeB}, 1, 1, ErlayCapacity(0)),
+				nodeB: MakeHybridNode(nodeB, []string{nodeA, nodeC}, 1, 1, ErlayCapacity(0)),
+				nodeC: MakeHybridNode(nodeC, []string{nodeB}, 1, 1, ErlayCapacity(0)),
+			},
+			// Tick 0: A(M1*)
+			// Tick 1: B(a.M1)
+			// Tick 2: C(b.req)
+			// Tick 3: B(c.sketch)
+			// Tick 4: C(b.M1, b.resp)
+			messages: map[int][]Message{
+				0: {
+					&ChannelUpdate{id: 1, Node: nodeA, chanID: "chan1"},
+				},
+			},
+			checkResults: func(t *testing.T, dbc *labelledDB) {
+				count, err := GetDuplicateCount(dbc, 1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if count != 0 {
+					t.Fatalf("Expected have no duplicates, got: %v", count)
+				}
+
+				latency, err := GetMessageLatency(dbc, 1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if latency != 4 {
+					t.Fatalf("Expected latency: %v, got %v", 4, latency)
+				}
+			},
+		},
+
+		{
+			name: "Staggered broadcast linear nodes",
+			// A ---- B ---- C
+			nodes: map[string]Node{
+				nodeA: MakeStaggeredFloodNode(nodeA, []string{nodeB}, 2),
+				nodeB: MakeStaggeredFloodNode(nodeB, []string{nodeA, nodeC}, 2),
+				nodeC: MakeStaggeredFloodNode(nodeC, []string{nodeB}, 2),
+			},
+			// M2 is a newer version of M1, so A only broadcasts M2.
+			// Tick 0: A(M1*)
+			// Tick 1: A(M2*)
+			// Tick 2: B(a.M2)
+			// Tick 4: C(b.M2)
+			messages: map[int][]Message{
+				0: {
+					&ChannelUpdate{id: 1, Node: nodeA, chanID: "chan1",
+						ts: time.Unix(1, 0)},
+				},
+				1: {
+					&ChannelUpdate{id: 2, Node: nodeA, chanID: "chan1",
+						ts: time.Unix(2, 0)},
+				},
+			},
+			checkResults: func(t *testing.T, dbc *labelledDB) {
+				count, err := GetDuplicateBucket(dbc, 1, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if count != 1 {
+					t.Fatalf("Expected only A to see M1, got: %v", count)
+				}
+
+				latency, err := GetMessageLatency(dbc, 2)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if latency != 3 {
+					t.Fatalf("Expected latency: %v, got %v", 3, latency)
+				}
+			},
+		},
+
+		{
+			name: "Syncer triangle",
+			// A ---- B
+			//  \    /
+			//   \  /
+			//    C
+			// Each node takes live gossip from its first peer, so A
+			// takes gossip from B and B and C take gossip from A.
+			nodes: map[string]Node{
+				nodeA: MakeSyncerNode(nodeA, []string{nodeB, nodeC}, 1, 0),
+				nodeB: MakeSyncerNode(nodeB, []string{nodeA, nodeC}, 1, 0),
+				nodeC: MakeSyncerNode(nodeC, []string{nodeA, nodeB}, 1, 0),
+			},
+			// Tick 1: A(b.filter, c.filter) B(a.filter, c.filter)
+			//		   C(a.filter, b.filter)
+			// Tick 2: A(M1*)
+			// Tick 3: B(a.M1) C(a.M1), B and C do not relay to each
+			//		   other because they are passive peers
+			messages: map[int][]Message{
+				2: {
+					&ChannelUpdate{id: 1, Node: nodeA, chanID: "chan1"},
+				},
+			},
+			checkResults: func(t *testing.T, dbc *labelledDB) {
+				count, err := GetDuplicateCount(dbc, 1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if count != 0 {
+					t.Fatalf("Expected have no duplicates, got: %v", count)
+				}
+
+				count, err = GetDuplicateBucket(dbc, 1, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if count != 3 {
+					t.Fatalf("Expected all nodes to receive M1, got: %v", count)
+				}
+			},
+		},
+
+		{
+			name: "Epidemic push linear nodes",
+			// A ---- B ---- C
+			// With a fanout of one and no pulls, each node can only
+			// push to the peer that did not send it the message.
+			nodes: map[string]Node{
+				nodeA: MakeEpidemicNode(nodeA, []string{nodeB}, 1, 0, 1),
+				nodeB: MakeEpidemicNode(nodeB, []string{nodeA, nodeC}, 1, 0, 1),
+				nodeC: MakeEpidemicNode(nodeC, []string{nodeB}, 1, 0, 1),
+			},
+			// Tick 0: A(M1*)
+			// Tick 1: B(a.M1)
+			// Tick 2: C(b.M1)
+			messages: map[int][]Message{
+				0: {
+					&ChannelUpdate{id: 1, Node: nodeA, chanID: "chan1"},
+				},
+			},
+			checkResults: func(t *testing.T, dbc *labelledDB) {
+				latency, err := GetMessageLatency(dbc, 1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if latency != 2 {
+					t.Fatalf("Expected latency: %v, got %v", 2, latency)
+				}
+			},
+		},
+
+		{
+			name: "Epidemic pull",
+			// A ---- B
+			// Nodes never push, and always pull when they can.
+			nodes: map[string]Node{
+				nodeA: MakeEpidemicNode(nodeA, []string{nodeB}, 0, 1, 1),
+				nodeB: MakeEpidemicNode(nodeB, []string{nodeA}, 0, 1, 1),
+			},
+			// Tick 0: A(M1*)
+			// Tick 1: A(b.query_channel_range) B(a.query_channel_range)
+			// Tick 2: A(b.reply_channel_range) B(a.reply_channel_range)
+			// Tick 3: A(b.query_short_channel_ids)
+			// Tick 4: B(a.M1)
+			messages: map[int][]Message{
+				0: {
+					&ChannelUpdate{id: 1, Node: nodeA, chanID: "chan1"},
+				},
+			},
+			checkResults: func(t *testing.T, dbc *labelledDB) {
+				latency, err := GetMessageLatency(dbc, 1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if latency != 4 {
+					t.Fatalf("Expected latency: %v, got %v", 4, latency)
+				}
+			},
+		},
+
+		{
+			name: "Bandwidth linear nodes",
+			// A ---- B ---- C
+			nodes: map[string]Node{
+				nodeA: MakeFloodNode(nodeA, []string{nodeB}),
+				nodeB: MakeFloodNode(nodeB, []string{nodeA, nodeC}),
+				nodeC: MakeFloodNode(nodeC, []string{nodeB}),
+			},
+			// Tick 0: A(M1*)
+			// Tick 1: B(a.M1)
+			// Tick 2: C(b.M1)
+			messages: map[int][]Message{
+				0: {
+					&ChannelUpdate{id: 1, Node: nodeA, chanID: "chan1",
+						byteLen: 100},
+				},
+			},
+			checkResults: func(t *testing.T, dbc *labelledDB) {
+				expected := map[string][2]int{
+					nodeA: {100, 0},
+					nodeB: {100, 100},
+					nodeC: {0, 100},
+				}
+
+				for node, bytes := range expected {
+					sent, received, err := GetBandwidth(dbc, node)
+					require.NoError(t, err)
+					require.Equal(t, bytes[0], sent, node)
+					require.Equal(t, bytes[1], received, node)
+				}
+			},
+		},
+
+		{
+			name: "Channel announcement",
+			// A ---- B ---- C
+			nodes: map[string]Node{
+				nodeA: MakeFloodNode(nodeA, []string{nodeB}),
+				nodeB: MakeFloodNode(nodeB, []string{nodeA, nodeC}),
+				nodeC: MakeFloodNode(nodeC, []string{nodeB}),
+			},
+			// The announcement and update for chan1 have different
+			// IDs, so nodes relay both.
+			// Tick 0: A(M1*) C(M1*) A(M2*)
+			// Tick 1: B(a.M1, c.M1, a.M2)
+			// Tick 2: C(b.M2)
+			messages: map[int][]Message{
+				0: {
+					&ChannelAnnouncement{id: 1, Node1: nodeA,
+						Node2: nodeC, chanID: "chan1"},
+					&ChannelUpdate{id: 2, Node: nodeA, chanID: "chan1"},
+				},
+			},
+			checkResults: func(t *testing.T, dbc *labelledDB) {
+				count, err := GetDuplicateCount(dbc, 1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if count != 1 {
+					t.Fatalf("Expected B to receive one duplicate, got: %v", count)
+				}
+
+				count, err = GetDuplicateBucket(dbc, 2, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if count != 3 {
+					t.Fatalf("Expected all nodes to receive M2, got: %v", count)
+				}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dbc := connectAndResetForTesting(t)
+
+			mMgr := &floodManager{
+				messages:   test.messages,
+				lastBucket: len(test.messages),
+			}
+
+			simulate(dbc, mMgr, test.nodes, nil)
+
+			test.checkResults(t, dbc)
+		})
+	}
+}
+
+func TestQueryPeer(t *testing.T) {
+	dbc := connectAndResetForTesting(t)
+
+	nodeA, nodeB := "nodeA", "nodeB"
+
+	// A does not know about B, so it will not push messages to it and B
+	// can only learn about them by querying A.
+	nodes := map[string]Node{
+		nodeA: MakeFloodNode(nodeA, nil),
+		nodeB: MakeFloodNode(nodeB, []string{nodeA}),
+	}
+
+	mMgr := &floodManager{
+		messages: map[int][]Message{
+			0: {
+				&ChannelUpdate{id: 1, Node: nodeA, chanID: "chan1"},
+				&ChannelUpdate{id: 2, Node: nodeA, chanID: "chan2"},
+			},
+		},
+		lastBucket: 1,
+	}
+
+	simulate(dbc, mMgr, nodes, nil)
+
+	// Tick 0: B(query_channel_range)
+	// Tick 1: A(b.query_channel_range)
+	// Tick 2: B(a.reply_channel_range)
+	// Tick 3: A(b.query_short_channel_ids)
+	// Tick 4: B(a.M1, a.M2, a.reply_short_channel_ids_end)
+	nodes[nodeB].(Querier).QueryPeer(nodeA)
+	simulate(dbc, &floodManager{}, nodes, nil)
+
+	for i := 1; i < 3; i++ {
+		count, err := GetDuplicateBucket(dbc, int64(i), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 2 {
+			t.Fatalf("Expected A and B to have M%v, got: %v", i, count)
+		}
+	}
+}
+
+func TestNodeAnnouncement(t *testing.T) {
+	dbc := connectAndResetForTesting(t)
+
+	nodeA, nodeB := "nodeA", "nodeB"
+
+	// B can only learn about A's announcements by querying A.
+	nodes := map[string]Node{
+		nodeA: MakeFloodNode(nodeA, nil),
+		nodeB: MakeFloodNode(nodeB, []string{nodeA}),
+	}
+
+	start := time.Now()
+
+	// A receives an old version of its announcement after the new one,
+	// which should not replace the new version.
+	mMgr := &floodManager{
+		messages: map[int][]Message{
+			0: {
+				&NodeAnnouncement{id: 2, Node: nodeA,
+					ts: start.Add(time.Hour)},
+			},
+			1: {
+				&NodeAnnouncement{id: 1, Node: nodeA, ts: start},
+			},
+		},
+		lastBucket: 1,
+	}
+
+	simulate(dbc, mMgr, nodes, nil)
+
+	nodes[nodeB].(Querier).QueryPeer(nodeA)
+	simulate(dbc, &floodManager{}, nodes, nil)
+
+	count, err := GetDuplicateBucket(dbc, 2, 0)
+	require.NoError(t, err)
+	require.Equal(t, 2, count, "expected A and B to have the new version")
+
+	count, err = GetDuplicateBucket(dbc, 1, 0)
+	require.NoError(t, err)
+	require.Equal(t, 1, count, "expected only A to have the old version")
+}
+
+func TestTimestampFilter(t *testing.T) {
+	dbc := connectAndResetForTesting(t)
+
+	nodeA, nodeB, nodeC := "nodeA", "nodeB", "nodeC"
+
+	// A ---- B ---- C
+	nodes := map[string]Node{
+		nodeA: MakeFloodNode(nodeA, []string{nodeB}),
+		nodeB: MakeFloodNode(nodeB, []string{nodeA, nodeC}),
+		nodeC: MakeFloodNode(nodeC, []string{nodeB}),
+	}
+
+	// Every node asks its first peer for gossip, so C asks B for all
+	// gossip and B turns gossip off from C.
+	applyTimestampFilters(nodes, 1)
+
+	// C sends B a filter that only allows messages from the first second.
+	nodes[nodeC].(TimestampFilterer).SendTimestampFilter(nodeB, TimestampFilter{
+		FirstTimestamp: time.Unix(0, 0),
+		EndTimestamp:   time.Unix(1, 0),
+	})
+
+	mMgr := &floodManager{
+		messages: map[int][]Message{
+			1: {
+				// M1 is inside C's filter, M2 is not.
+				&ChannelUpdate{id: 1, Node: nodeA, chanID: "chan1",
+					ts: time.Unix(0, 0)},
+				&ChannelUpdate{id: 2, Node: nodeA, chanID: "chan2",
+					ts: time.Unix(2, 0)},
+				// Nodes always relay messages they originate, so
+				// M3 reaches C and M4 reaches B even though B has
+				// turned gossip off from C.
+				&ChannelUpdate{id: 3, Node: nodeB, chanID: "chan3",
+					ts: time.Unix(2, 0)},
+				&ChannelUpdate{id: 4, Node: nodeC, chanID: "chan4",
+					ts: time.Unix(0, 0)},
+			},
+		},
+		lastBucket: 2,
+	}
+
+	simulate(dbc, mMgr, nodes, nil)
+
+	tests := []struct {
+		uuid      int64
+		receivers int
+	}{
+		{1, 3},
+		{2, 2},
+		{3, 3},
+		{4, 3},
+	}
+
+	for _, test := range tests {
+		count, err := GetDuplicateBucket(dbc, test.uuid, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != test.receivers {
+			t.Fatalf("Expected M%v to reach %v nodes, got: %v",
+				test.uuid, test.receivers, count)
+		}
+	}
+}
+
+func TestSyncerRotation(t *testing.T) {
+	dbc := connectAndResetForTesting(t)
+
+	nodeA, nodeB, nodeC := "nodeA", "nodeB", "nodeC"
+
+	node := MakeSyncerNode("node", []string{nodeA, nodeB, nodeC}, 1, 2)
+
+	// When the simulation starts, A is made active and the rest passive.
+	node.ProgressQueue()
+	require.Equal(t, map[string][]Message{
+		nodeA: {&gossipTimestampFilter{filter: AllGossip}},
+		nodeB: {&gossipTimestampFilter{filter: NoGossip}},
+		nodeC: {&gossipTimestampFilter{filter: NoGossip}},
+	}, node.GetQueue())
+
+	update1 := &ChannelUpdate{id: 1, Node: nodeA, chanID: "chan1"}
+	require.NoError(t, node.ReceiveMessage(dbc, update1, 1, nodeA))
+	node.ProgressQueue()
+	require.Empty(t, node.GetQueue())
+
+	// After two ticks, A is replaced by B and we sync with B.
+	node.ProgressQueue()
+	require.Equal(t, map[string][]Message{
+		nodeA: {&gossipTimestampFilter{filter: NoGossip}},
+		nodeB: {
+			&gossipTimestampFilter{filter: AllGossip},
+			&queryChannelRange{},
+		},
+	}, node.GetQueue())
+
+	update2 := &ChannelUpdate{id: 2, Node: nodeB, chanID: "chan2"}
+	require.NoError(t, node.ReceiveMessage(dbc, update2, 3, nodeB))
+	node.ProgressQueue()
+	node.ProgressQueue()
+	require.Equal(t, map[string][]Message{
+		nodeB: {&gossipTimestampFilter{filter: NoGossip}},
+		nodeC: {
+			&gossipTimestampFilter{filter: AllGossip},
+			&queryChannelRange{},
+		},
+	}, node.GetQueue())
+
+	// Once no new messages arrive, rotations stop.
+	for i := 0; i < 4; i++ {
+		node.ProgressQueue()
+		require.Empty(t, node.GetQueue())
+	}
+}
+
+func TestSyncerSettles(t *testing.T) {
+	dbc := connectAndResetForTesting(t)
+
+	// A ---- B ---- C ---- D, where each node has a single active syncer
+	// and rotates it every other tick, so that rotations keep sending
+	// filters and queries every tick after the messages run out.
+	pubkeys := []string{"nodeA", "nodeB", "nodeC", "nodeD"}
+	nodes := make(map[string]Node)
+	for i, pubkey := range pubkeys {
+		var peers []string
+		if i > 0 {
+			peers = append(peers, pubkeys[i-1])
+		}
+		if i < len(pubkeys)-1 {
+			peers = append(peers, pubkeys[i+1])
+		}
+
+		nodes[pubkey] = MakeSyncerNode(pubkey, peers, 1, 2)
+	}
+
+	mMgr := &floodManager{
+		messages: map[int][]Message{
+			0: {&ChannelUpdate{id: 1, Node: "nodeA", chanID: "chan1"}},
+			1: {&ChannelUpdate{id: 2, Node: "nodeD", chanID: "chan2"}},
+		},
+		lastBucket: 1,
+	}
+
+	// Rotations carry on after the messages run out, but stop once the
+	// nodes have nothing new to sync, so the simulation ends.
+	chanGraph := NewChannelGraph(nodes)
+	var ticks int
+	for ; ticks < 100; ticks++ {
+		result, err := chanGraph.Tick(dbc, mMgr)
+		require.NoError(t, err)
+
+		if result.done {
+			break
+		}
+	}
+	require.Less(t, ticks, 100)
+
+	for _, pubkey := range pubkeys {
+		require.Len(t, nodes[pubkey].GetMessages(), 2, pubkey)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	dbc := connectAndResetForTesting(t)
+
+	nodeA, nodeB := "nodeA", "nodeB"
+
+	// B accepts one update per channel every two ticks.
+	nodeBNode := MakeFloodNode(nodeB, []string{nodeA})
+	nodeBNode.(RateLimited).SetRateLimiter(NewTokenBucketLimiter(
+		TokenBucketConfig{Rate: 0.5, Burst: 1}, TokenBucketConfig{},
+	))
+
+	nodes := map[string]Node{
+		nodeA: MakeFloodNode(nodeA, []string{nodeB}),
+		nodeB: nodeBNode,
+	}
+
+	// Tick 1: B(a.M1)
+	// Tick 2: B(a.M2), dropped because B has no tokens for chan1
+	// Tick 3: B(a.M3), accepted because B has a new token for chan1
+	mMgr := &floodManager{
+		messages: map[int][]Message{
+			0: {
+				&ChannelUpdate{id: 1, Node: nodeA, chanID: "chan1",
+					ts: time.Unix(1, 0)},
+			},
+			1: {
+				&ChannelUpdate{id: 2, Node: nodeA, chanID: "chan1",
+					ts: time.Unix(2, 0)},
+			},
+			2: {
+				&ChannelUpdate{id: 3, Node: nodeA, chanID: "chan1",
+					ts: time.Unix(3, 0)},
+			},
+		},
+		lastBucket: 3,
+	}
+
+	simulate(dbc, mMgr, nodes, nil)
+
+	tests := []struct {
+		uuid      int64
+		receivers int
+		dropped   int
+	}{
+		{1, 2, 0},
+		{2, 1, 1},
+		{3, 2, 0},
+	}
+
+	for _, test := range tests {
+		count, err := GetDuplicateBucket(dbc, test.uuid, 0)
+		require.NoError(t, err)
+		require.Equal(t, test.receivers, count)
+
+		dropped, err := GetDroppedCount(dbc, test.uuid)
+		require.NoError(t, err)
+		require.Equal(t, test.dropped, dropped)
+	}
+}
+
+func TestDependencies(t *testing.T) {
+	nodeA, nodeB, nodeC := "nodeA", "nodeB", "nodeC"
+
+	tests := []struct {
+		name      string
+		mode      DependencyMode
+		receivers int
+		dropped   int
+		deferred  int
+	}{
+		{
+			name: "off",
+			mode: DependenciesOff,
+			// All messages are relayed without checks.
+			receivers: 3,
+		},
+		{
+			name: "defer",
+			mode: DependenciesDefer,
+			// A holds M1 and C holds M2 until they receive M3.
+			receivers: 3,
+			deferred:  2,
+		},
+		{
+			name: "reject",
+			mode: DependenciesReject,
+			// A drops M1 and C drops M2.
+			receivers: 0,
+			dropped:   1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dbc := connectAndResetForTesting(t)
+
+			// A ---- B ---- C
+			nodes := map[string]Node{
+				nodeA: MakeFloodNode(nodeA, []string{nodeB}),
+				nodeB: MakeFloodNode(nodeB, []string{nodeA, nodeC}),
+				nodeC: MakeFloodNode(nodeC, []string{nodeB}),
+			}
+			applyDependencies(nodes, test.mode, nil)
+
+			// Tick 0: A(M1*) C(M2*), neither A nor C has a channel
+			// Tick 1: A(M3*) C(M3*), which announces chan1
+			mMgr := &floodManager{
+				messages: map[int][]Message{
+					0: {
+						&ChannelUpdate{id: 1, Node: nodeA,
+							chanID: "chan1"},
+						&NodeAnnouncement{id: 2, Node: nodeC},
+					},
+					1: {
+						&ChannelAnnouncement{id: 3, Node1: nodeA,
+							Node2: nodeC, chanID: "chan1"},
+					},
+				},
+				lastBucket: 1,
+			}
+
+			simulate(dbc, mMgr, nodes, nil)
+
+			for _, uuid := range []int64{1, 2} {
+				count, err := GetDuplicateBucket(dbc, uuid, 0)
+				require.NoError(t, err)
+				require.Equal(t, test.receivers, count)
+
+				dropped, err := GetDroppedCount(dbc, uuid)
+				require.NoError(t, err)
+				require.Equal(t, test.dropped, dropped)
+			}
+
+			count, err := GetDuplicateBucket(dbc, 3, 0)
+			require.NoError(t, err)
+			require.Equal(t, 3, count)
+
+			_, deferred, pending := dependencyTotals(nodes)
+			require.Equal(t, test.deferred, deferred)
+			require.Zero(t, pending)
+		})
+	}
+}
+
+func TestSyntheticWorkload(t *testing.T) {
+	nodeA, nodeB, nodeC := "nodeA", "nodeB", "nodeC"
+
+	graph := NewGraphChannels()
+	graph.AddChannel(1, nodeA, nodeB)
+	graph.AddChannel(2, nodeB, nodeC)
+
+	cfg := SyntheticConfig{
+		Ticks:                20,
+		UpdateRate:           8,
+		BurstRate:            8,
+		KeepAliveShare:       0.5,
+		NewChannelRate:       16,
+		NodeAnnouncementRate: 4,
+		TickDuration:         time.Second * 90,
+		Seed:                 1,
+	}
+
+	// The same seed always generates the same workload.
+	mMgr := NewSyntheticMessageManager(graph, cfg)
+	require.Equal(t, mMgr, NewSyntheticMessageManager(graph, cfg))
+
+	cfg.Seed = 2
+	require.NotEqual(t, mMgr, NewSyntheticMessageManager(graph, cfg))
+
+	// Announcements are always generated before the messages that depend
+	// on them, so nodes that reject messages without their dependencies
+	// accept the whole workload.
+	dbc := connectAndResetForTesting(t)
+
+	// A ---- B ---- C
+	nodes := map[string]Node{
+		nodeA: MakeFloodNode(nodeA, []string{nodeB}),
+		nodeB: MakeFloodNode(nodeB, []string{nodeA, nodeC}),
+		nodeC: MakeFloodNode(nodeC, []string{nodeB}),
+	}
+	applyDependencies(nodes, DependenciesReject, graph)
+
+	simulate(dbc, mMgr, nodes, nil)
+
+	rejected, _, _ := dependencyTotals(nodes)
+	require.Zero(t, rejected)
+
+	// Updates may be replaced by a newer version before they reach every
+	// node, but channel announcements are never replaced.
+	var announcements int
+	for tick := 0; tick < cfg.Ticks; tick++ {
+		messages, _ := mMgr.GetNewMessages(tick)
+		for _, msg := range messages {
+			receivers, err := GetDuplicateBucket(dbc, msg.UUID(), 0)
+			require.NoError(t, err)
+			require.NotZero(t, receivers)
+
+			if _, ok := msg.(*ChannelAnnouncement); ok {
+				require.Equal(t, 3, receivers)
+				announcements++
+			}
+		}
+	}
+	require.NotZero(t, announcements)
+}
+
+func TestSyntheticRate(t *testing.T) {
+	// 20 nodes with a channel to each of the next three nodes.
+	graph := NewGraphChannels()
+	var chanID uint64
+	for i := 0; i < 20; i++ {
+		for j := 1; j <= 3; j++ {
+			chanID++
+			graph.AddChannel(chanID, fmt.Sprintf("node%v", i),
+				fmt.Sprintf("node%v", (i+j)%20))
+		}
+	}
+
+	// counts returns the number of each type of message generated over a
+	// day with ticks of the duration provided.
+	counts := func(tick time.Duration) map[string]int {
+		cfg := SyntheticConfig{
+			Ticks:                int(24 * time.Hour / tick),
+			UpdateRate:           1,
+			BurstRate:            1,
+			NewChannelRate:       2,
+			NodeAnnouncementRate: 0.5,
+			TickDuration:         tick,
+			Seed:                 1,
+		}
+		mMgr := NewSyntheticMessageManager(graph, cfg)
+
+		counts := make(map[string]int)
+		for i := 0; i < cfg.Ticks; i++ {
+			messages, _ := mMgr.GetNewMessages(i)
+			for _, msg := range messages {
+				counts[fmt.Sprintf("%T", msg)]++
+			}
+		}
+
+		return counts
+	}
+
+	// Rates are set per hour, so the workload has the same rate of each
+	// type of message whatever the tick duration.
+	fine, coarse := counts(time.Second*10), counts(time.Second*90)
+	require.Len(t, coarse, 3)
+	for msgType, count := range coarse {
+		require.InEpsilon(t, count, fine[msgType], 0.15, msgType)
+	}
+}
+
+func TestDedupStrategy(t *testing.T) {
+	start := time.Date(2019, 7, 10, 14, 0, 0, 0, time.UTC)
+
+	policy1 := chanPolicy{baseFee: 1000, feeRate: 1}
+	policy2 := chanPolicy{baseFee: 1000, feeRate: 2}
+
+	// The same policy set by the other node of the channel.
+	policy3 := chanPolicy{baseFee: 1000, feeRate: 1, chanFlags: 1}
+
+	updates := []dbChanUpdate{
+		{id: 1, chanID: "chan1", ts: start, chanPolicy: policy1},
+		// The same update received from another peer.
+		{id: 2, chanID: "chan1", ts: start, chanPolicy: policy1},
+		// An update for the other direction of the channel, which
+		// does not replace updates for the first.
+		{id: 7, chanID: "chan1", ts: start.Add(time.Second * 30),
+			chanPolicy: policy3},
+		// A refresh of the update a minute later.
+		{id: 3, chanID: "chan1", ts: start.Add(time.Minute),
+			chanPolicy: policy1},
+		{id: 4, chanID: "chan1", ts: start.Add(time.Minute * 2),
+			chanPolicy: policy2},
+		{id: 5, chanID: "chan2", ts: start.Add(time.Minute * 10),
+			chanPolicy: policy1},
+		{id: 6, chanID: "chan1", ts: start.Add(time.Minute * 10),
+			chanPolicy: policy2},
+	}
+
+	tests := []struct {
+		strategy string
+		expected []int64
+	}{
+		{"none", []int64{1, 2, 7, 3, 4, 5, 6}},
+		{"exact", []int64{1, 7, 3, 4, 5, 6}},
+		{"window", []int64{1, 7, 4, 5, 6}},
+		{"bucket", []int64{7, 3, 4, 5, 6}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.strategy, func(t *testing.T) {
+			dedup, err := ParseDedupStrategy(test.strategy,
+				time.Minute*5, start, time.Second*90)
+			require.NoError(t, err)
+
+			var ids []int64
+			for _, update := range dedup.Filter(updates) {
+				ids = append(ids, update.id)
+			}
+			require.Equal(t, test.expected, ids)
+		})
+	}
+
+	// Every strategy's count is kept, whichever one is used.
+	counts, err := newDedupCounts(time.Minute*5, start, time.Second*90)
+	require.NoError(t, err)
+
+	counts.add(updates)
+	for i, test := range tests {
+		require.Equal(t, len(updates)-len(test.expected),
+			counts.removed[i], test.strategy)
+	}
+}
+
+func TestChannelFlags(t *testing.T) {
+	tests := []struct {
+		name      string
+		chanFlags int
+		msgFlags  int
+		expected  *ChannelUpdate
+	}{
+		{
+			name: "Enabled node 1",
+			expected: &ChannelUpdate{
+				Node: "nodeA",
+			},
+		},
+		{
+			name:      "Enabled node 2",
+			chanFlags: 1,
+			msgFlags:  1,
+			expected: &ChannelUpdate{
+				Node:       "nodeB",
+				Direction:  1,
+				HasMaxHTLC: true,
+			},
+		},
+		{
+			name:      "Disabled node 1",
+			chanFlags: 2,
+			expected: &ChannelUpdate{
+				Node:     "nodeA",
+				Disabled: true,
+			},
+		},
+		{
+			// The direction bit alone decides the origin node.
+			name:      "Disabled node 2",
+			chanFlags: 3,
+			msgFlags:  3,
+			expected: &ChannelUpdate{
+				Node:        "nodeB",
+				Direction:   1,
+				Disabled:    true,
+				HasMaxHTLC:  true,
+				DontForward: true,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			update := dbChanUpdate{
+				node1: "nodeA",
+				node2: "nodeB",
+			}
+			update.chanFlags = test.chanFlags
+			update.msgFlags = test.msgFlags
+
+			msg := newChannelUpdate(update)
+			require.Equal(t, test.expected, msg)
+
+			chanFlags, msgFlags := msg.flags()
+			require.Equal(t, test.chanFlags, chanFlags)
+			require.Equal(t, test.msgFlags, msgFlags)
+		})
+	}
+}
+
+func TestUpdateDirection(t *testing.T) {
+	nodeA, nodeB := "nodeA", "nodeB"
+	start := time.Unix(1000, 0)
+
+	// Each node of chan1 sends an update for its direction.
+	update1 := &ChannelUpdate{id: 1, Node: nodeA, chanID: "chan1",
+		ts: start}
+	update2 := &ChannelUpdate{id: 2, Node: nodeB, chanID: "chan1",
+		ts: start, Direction: 1}
+	require.NotEqual(t, update1.ID(), update2.ID())
+
+	// A peer that only has node 1's update is missing node 2's.
+	require.Equal(t, []Message{update2}, missingMessages(
+		[]Message{update1, update2}, []Message{update1},
+	))
+
+	// A node keeps the newest update for each direction.
+	dbc := connectAndResetForTesting(t)
+	nodeC := "nodeC"
+	node := MakeFloodNode(nodeC, nil)
+	applyDependencies(map[string]Node{nodeC: node}, DependenciesDefer, nil)
+
+	update3 := &ChannelUpdate{id: 3, Node: nodeA, chanID: "chan1",
+		ts: start.Add(time.Second)}
+	for _, msg := range []Message{update1, update2, update3} {
+		require.NoError(t, node.ReceiveMessage(dbc, msg, 0, nodeA))
+	}
+	require.Empty(t, node.GetMessages())
+
+	// Both directions wait for the channel announcement, and are released
+	// by it.
+	announcement := &ChannelAnnouncement{id: 4, Node1: nodeA, Node2: nodeB,
+		chanID: "chan1"}
+	require.NoError(t, node.ReceiveMessage(dbc, announcement, 1, nodeA))
+	require.Equal(t, []Message{announcement, update3, update2},
+		node.GetMessages())
+}
+
+func TestDontForward(t *testing.T) {
+	nodeA, nodeB, nodeC := "nodeA", "nodeB", "nodeC"
+
+	protocols := []struct {
+		name string
+		make func(pubkey string, peers []string) Node
+	}{
+		{
+			name: "flood",
+			make: MakeFloodNode,
+		},
+		{
+			name: "inv",
+			make: MakeInvNode,
+		},
+		{
+			name: "recon",
+			make: func(pubkey string, peers []string) Node {
+				return MakeReconNode(pubkey, peers, 1,
+					ErlayCapacity(1))
+			},
+		},
+		{
+			name: "epidemic",
+			make: func(pubkey string, peers []string) Node {
+				return MakeEpidemicNode(pubkey, peers, 2, 0, 1)
+			},
+		},
+	}
+
+	for _, protocol := range protocols {
+		t.Run(protocol.name, func(t *testing.T) {
+			dbc := connectAndResetForTesting(t)
+
+			// A ---- B ---- C
+			nodes := map[string]Node{
+				nodeA: protocol.make(nodeA, []string{nodeB}),
+				nodeB: protocol.make(nodeB, []string{nodeA, nodeC}),
+				nodeC: protocol.make(nodeC, []string{nodeB}),
+			}
+
+			// Tick 0: A(M1*) A(M2*), where M1 must not be forwarded
+			// past B.
+			update1 := &ChannelUpdate{id: 1, Node: nodeA,
+				chanID: "chan1", DontForward: true}
+			update2 := &ChannelUpdate{id: 2, Node: nodeA,
+				chanID: "chan2"}
+			mMgr := &floodManager{
+				messages: map[int][]Message{
+					0: {update1, update2},
+				},
+			}
+
+			simulate(dbc, mMgr, nodes, nil)
+
+			require.Equal(t, []Message{update1, update2},
+				nodes[nodeB].GetMessages())
+			require.Equal(t, []Message{update2},
+				nodes[nodeC].GetMessages())
+		})
+	}
+}
+
+func TestMessageFile(t *testing.T) {
+	start := time.Date(2019, 7, 10, 14, 0, 0, 0, time.UTC)
+
+	messages := []Message{
+		&ChannelAnnouncement{id: 1, Node1: "nodeA", Node2: "nodeB",
+			chanID: "chan1", ts: start.Add(time.Second), byteLen: 430},
+		&NodeAnnouncement{id: 2, Node: "nodeA",
+			ts: start.Add(time.Minute), byteLen: 142},
+		&ChannelUpdate{id: 3, Node: "nodeB", chanID: "chan1",
+			ts: start.Add(time.Hour), byteLen: 138, Direction: 1,
+			Disabled: true, HasMaxHTLC: true},
+	}
+
+	for _, path := range []string{"messages.jsonl", "messages.csv"} {
+		t.Run(path, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), path)
+
+			file, err := os.Create(path)
+			require.NoError(t, err)
+			require.NoError(t, WriteMessages(file, messages, isCSV(path)))
+			require.NoError(t, file.Close())
+
+			file, err = os.Open(path)
+			require.NoError(t, err)
+			defer file.Close()
+
+			read, err := ReadMessages(file, isCSV(path))
+			require.NoError(t, err)
+			require.Equal(t, messages, read)
+
+			// Messages are bucketed from the first message in the
+			// file.
+			mMgr, err := NewFileMessageManager(path, time.Second*90)
+			require.NoError(t, err)
+			require.Equal(t, &floodManager{
+				messages: map[int][]Message{
+					0:  {messages[0], messages[1]},
+					39: {messages[2]},
+				},
+				lastBucket: 39,
+				start:      read[0].TimeStamp(),
+			}, mMgr)
+
+			mMgr, err = NewFileMessageManager(path, time.Second*10)
+			require.NoError(t, err)
+			require.Equal(t, &floodManager{
+				messages: map[int][]Message{
+					0:   {messages[0]},
+					5:   {messages[1]},
+					359: {messages[2]},
+				},
+				lastBucket: 359,
+				start:      read[0].TimeStamp(),
+			}, mMgr)
+		})
+	}
+
+	// Files with a start record are bucketed from the start time, so a
+	// quiet period at the start of the file is kept.
+	for _, path := range []string{"start.jsonl", "start.csv"} {
+		t.Run(path, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), path)
+
+			file, err := os.Create(path)
+			require.NoError(t, err)
+
+			writer, err := newMessageWriter(file, isCSV(path))
+			require.NoError(t, err)
+			require.NoError(t, writer.writeStart(
+				start.Add(-3*time.Minute),
+			))
+			require.NoError(t, writer.write(messages))
+			require.NoError(t, writer.flush())
+			require.NoError(t, file.Close())
+
+			file, err = os.Open(path)
+			require.NoError(t, err)
+			defer file.Close()
+
+			read, err := ReadMessages(file, isCSV(path))
+			require.NoError(t, err)
+			require.Equal(t, messages, read)
+
+			mMgr, err := NewFileMessageManager(path, time.Second*90)
+			require.NoError(t, err)
+			require.Equal(t, &floodManager{
+				messages: map[int][]Message{
+					2:  {messages[0], messages[1]},
+					42: {messages[2]},
+				},
+				lastBucket: 42,
+				start:      start.Add(-3 * time.Minute),
+			}, mMgr)
+		})
+	}
+}
+
+// sliceRows is a row source that reads rows from a slice in position order.
+type sliceRows []row
+
+func (s sliceRows) readRows(start, end time.Time, after *position,
+	limit int) ([]row, error) {
+
+	var read []row
+	for _, r := range s {
+		if r.pos.ts.Before(start) || !r.pos.ts.Before(end) {
+			continue
+		}
+
+		if after != nil && (r.pos.ts.Before(after.ts) ||
+			(r.pos.ts.Equal(after.ts) && r.pos.uuid <= after.uuid)) {
+
+			continue
+		}
+
+		if len(read) == limit {
+			break
+		}
+		read = append(read, r)
+	}
+
+	return read, nil
+}
+
+func TestCursor(t *testing.T) {
+	start := time.Date(2019, 7, 10, 14, 0, 0, 0, time.UTC)
+
+	rowAt := func(uuid int64, offset time.Duration) row {
+		return row{
+			item: uuid,
+			pos:  position{ts: start.Add(offset), uuid: uuid},
+		}
+	}
+
+	source := sliceRows{
+		rowAt(1, 0),
+		rowAt(2, 0),
+		rowAt(3, time.Second),
+		rowAt(4, time.Second*2),
+		rowAt(5, time.Second*2),
+		rowAt(6, time.Second*5),
+	}
+
+	// Pages of one row are read until a range is exhausted, including
+	// rows that share a timestamp.
+	c := newCursor(source, start, start.Add(time.Second*5), 1)
+
+	items, err := c.readUntil(start.Add(time.Second))
+	require.NoError(t, err)
+	require.Equal(t, []interface{}{int64(1), int64(2)}, items)
+
+	items, err = c.readUntil(start.Add(time.Second * 3))
+	require.NoError(t, err)
+	require.Equal(t, []interface{}{int64(3), int64(4), int64(5)}, items)
+
+	// Rows at the end time are outside of the window.
+	items, err = c.readUntil(start.Add(time.Second * 10))
+	require.NoError(t, err)
+	require.Empty(t, items)
+
+	items, err = c.readUntil(start.Add(time.Second * 20))
+	require.NoError(t, err)
+	require.Empty(t, items)
+}
+
+func TestStreamingManager(t *testing.T) {
+	start := time.Date(2019, 7, 10, 14, 0, 0, 0, time.UTC)
+	tick := time.Second * 10
+
+	announcement := &ChannelAnnouncement{id: 1, Node1: "nodeA",
+		Node2: "nodeB", chanID: "chan1", ts: start.Add(time.Second * 2)}
+	nodeAnnouncement := &NodeAnnouncement{id: 2, Node: "nodeA",
+		ts: start.Add(time.Second * 3)}
+
+	// The same announcement is received again in the next bucket.
+	duplicate := &ChannelAnnouncement{id: 4, Node1: "nodeA",
+		Node2: "nodeB", chanID: "chan1", ts: start.Add(time.Second * 11)}
+
+	policy := chanPolicy{baseFee: 1000, feeRate: 1}
+	update := func(uuid int64, offset time.Duration,
+		policy chanPolicy) dbChanUpdate {
+
+		return dbChanUpdate{
+			id:         uuid,
+			chanID:     "chan1",
+			ts:         start.Add(offset),
+			chanPolicy: policy,
+			node1:      "nodeA",
+			node2:      "nodeB",
+		}
+	}
+
+	updates := []dbChanUpdate{
+		update(3, time.Second, policy),
+		// A refresh in the next bucket, which the window strategy
+		// removes.
+		update(5, time.Second*12, policy),
+		update(6, time.Second*15, chanPolicy{baseFee: 1000, feeRate: 2}),
+		// An update at the end of the window is not read.
+		update(7, time.Second*20, policy),
+	}
+
+	channelAnnouncements := sliceRows{
+		{item: announcement, pos: position{announcement.ts, 1}},
+		{item: duplicate, pos: position{duplicate.ts, 4}},
+	}
+	nodeAnnouncements := sliceRows{
+		{item: nodeAnnouncement, pos: position{nodeAnnouncement.ts, 2}},
+	}
+	var updateRows sliceRows
+	for _, u := range updates {
+		updateRows = append(updateRows, row{
+			item: u,
+			pos:  position{ts: u.ts, uuid: u.id},
+		})
+	}
+
+	dedup, err := ParseDedupStrategy("window", time.Minute*5, start, tick)
+	require.NoError(t, err)
+
+	// The window ends at the start of the third bucket, so the second
+	// bucket is the last.
+	m, err := newStreamingManager(start, time.Second*20, tick, dedup,
+		channelAnnouncements, nodeAnnouncements, updateRows)
+	require.NoError(t, err)
+	require.Equal(t, 1, m.lastBucket)
+
+	// Announcements are released before the updates in their bucket,
+	// whatever their timestamps.
+	messages, done := m.GetNewMessages(0)
+	require.False(t, done)
+	require.Equal(t, []Message{
+		announcement, nodeAnnouncement, newChannelUpdate(updates[0]),
+	}, messages)
+
+	messages, done = m.GetNewMessages(1)
+	require.True(t, done)
+	require.Equal(t, []Message{newChannelUpdate(updates[2])}, messages)
+	require.Equal(t, 3, m.updateCount)
+	require.Equal(t, 1, m.removedCount)
+	require.NoError(t, m.Err())
+}
+
+func TestAntiEntropy(t *testing.T) {
+	dbc := connectAndResetForTesting(t)
+
+	nodeA, nodeB, nodeC := "nodeA", "nodeB", "nodeC"
+
+	// Nodes do not relay anything, so C can only get messages through
+	// anti-entropy with A.
+	nodes := map[string]Node{
+		nodeA: MakeEpidemicNode(nodeA, []string{nodeC}, 0, 0, 1),
+		nodeB: MakeEpidemicNode(nodeB, nil, 0, 0, 1),
+		nodeC: MakeEpidemicNode(nodeC, []string{nodeA}, 0, 0, 1),
+	}
+
+	chanGraph := NewChannelGraph(nodes)
+	chanGraph.AntiEntropy = NewAntiEntropy(2, 1, 0, 1)
+
+	mMgr := &floodManager{
+		messages: map[int][]Message{
+			0: {
+				&ChannelUpdate{id: 1, Node: nodeA, chanID: "chan1",
+					byteLen: 100},
+				&ChannelUpdate{id: 2, Node: nodeC, chanID: "chan2",
+					byteLen: 200},
+			},
+		},
+		lastBucket: 1,
+	}
+
+	// Tick 0: A(M1*) C(M2*), anti-entropy syncs A and C, which send each
+	// other a one entry digest and the message the other is missing.
+	result, err := chanGraph.Tick(dbc, mMgr)
+	require.NoError(t, err)
+	require.Equal(t, &repairResult{
+		pairs:         1,
+		digestEntries: 2,
+		repaired:      2,
+		bytes:         2*digestEntrySize + 300,
+	}, result.repair)
+	require.Equal(t, 2*digestEntrySize+300, result.bytesSent)
+	require.False(t, result.done)
+
+	sent, received, err := GetBandwidth(dbc, nodeA)
+	require.NoError(t, err)
+	require.Equal(t, digestEntrySize+100, sent)
+	require.Equal(t, digestEntrySize+200, received)
+
+	// Tick 1: no anti-entropy round, and relaying has settled but the
+	// simulation runs until a round finds nothing to repair.
+	result, err = chanGraph.Tick(dbc, mMgr)
+	require.NoError(t, err)
+	require.Equal(t, &repairResult{}, result.repair)
+	require.False(t, result.done)
+
+	// Tick 2: A and C are in sync, so the simulation ends.
+	result, err = chanGraph.Tick(dbc, mMgr)
+	require.NoError(t, err)
+	require.Equal(t, &repairResult{
+		pairs:         1,
+		digestEntries: 4,
+		bytes:         4 * digestEntrySize,
+	}, result.repair)
+	require.True(t, result.done)
+
+	for i := 1; i < 3; i++ {
+		count, err := GetDuplicateBucket(dbc, int64(i), 0)
+		require.NoError(t, err)
+		require.Equal(t, 2, count)
+	}
+}
+
+// TestAntiEntropyDone tests that anti-entropy is not done after a round that
+// repairs nothing while nodes outside of its pairs are missing messages.
+func TestAntiEntropyDone(t *testing.T) {
+	dbc := connectAndResetForTesting(t)
+
+	nodeA, nodeB := "nodeA", "nodeB"
+
+	nodes := map[string]Node{
+		nodeA: MakeEpidemicNode(nodeA, []string{nodeB}, 0, 0, 1),
+		nodeB: MakeEpidemicNode(nodeB, []string{nodeA}, 0, 0, 1),
+	}
+
+	msg := &ChannelUpdate{id: 1, Node: nodeA, chanID: "chan1"}
+	require.NoError(t, nodes[nodeA].ReceiveMessage(dbc, msg, 0, nodeA))
+
+	// Rounds sync no pairs, so they never repair anything.
+	antiEntropy := NewAntiEntropy(1, 0, 0, 1)
+
+	result, err := antiEntropy.Run(dbc, nodes, 0, true, bandwidthUsage{})
+	require.NoError(t, err)
+	require.Zero(t, result.repaired)
+	require.False(t, antiEntropy.Done())
+
+	require.NoError(t, nodes[nodeB].ReceiveMessage(dbc, msg, 1, nodeA))
+
+	_, err = antiEntropy.Run(dbc, nodes, 1, true, bandwidthUsage{})
+	require.NoError(t, err)
+	require.True(t, antiEntropy.Done())
+}
+
+func TestEventEngine(t *testing.T) {
+	dbc := connectAndResetForTesting(t)
+
+	nodeA, nodeB, nodeC := "nodeA", "nodeB", "nodeC"
+
+	// A ---- B ---- C
+	nodes := map[string]Node{
+		nodeA: MakeFloodNode(nodeA, []string{nodeB}),
+		nodeB: MakeFloodNode(nodeB, []string{nodeA, nodeC}),
+		nodeC: MakeFloodNode(nodeC, []string{nodeB}),
+	}
+
+	// Links take 250ms, except from C to B which takes a second.
+	delays := NewLinkDelays(fixedDelay(250*time.Millisecond), 1)
+	delays.SetLink(nodeC, nodeB, fixedDelay(time.Second))
+
+	eventGraph := NewEventGraph(nodes, delays, 100*time.Millisecond,
+		90*time.Second)
+
+	mMgr := &floodManager{
+		messages: map[int][]Message{
+			0: {&ChannelUpdate{id: 1, Node: nodeA, chanID: "chan1"}},
+			1: {&ChannelUpdate{id: 2, Node: nodeC, chanID: "chan2"}},
+		},
+		lastBucket: 1,
+	}
+
+	var ticks int
+	for {
+		result, err := eventGraph.Tick(dbc, mMgr)
+		require.NoError(t, err)
+		ticks++
+
+		if result.done {
+			break
+		}
+	}
+
+	// Step 0: A(M1*)
+	// Step 3 (300ms): B(a.M1), sent at 0ms and arrived at 250ms
+	// Step 6 (600ms): C(b.M1), sent at 300ms and arrived at 550ms
+	latency, err := GetMessageLatency(dbc, 1)
+	require.NoError(t, err)
+	require.Equal(t, 6, latency)
+
+	// Step 900 (90s): C(M2*)
+	// Step 910 (91s): B(c.M2), over the slow link
+	// Step 913 (91.3s): A(b.M2)
+	latency, err = GetMessageLatency(dbc, 2)
+	require.NoError(t, err)
+	require.Equal(t, 13, latency)
+
+	// Steps with nothing to deliver are skipped.
+	require.Less(t, ticks, 20)
+	require.Equal(t, 914, eventGraph.StepCount)
+}
+
+// TestEventTimers tests that node timers count steps in the event engine,
+// and fire on time while there is nothing else to do.
+func TestEventTimers(t *testing.T) {
+	dbc := connectAndResetForTesting(t)
+
+	nodeA, nodeB, nodeC := "nodeA", "nodeB", "nodeC"
+
+	// B ---- A ---- C
+	// A rotates its active syncer every 10 steps.
+	nodes := map[string]Node{
+		nodeA: MakeSyncerNode(nodeA, []string{nodeB, nodeC}, 1, 10),
+		nodeB: MakeSyncerNode(nodeB, []string{nodeA}, 1, 0),
+		nodeC: MakeSyncerNode(nodeC, []string{nodeA}, 1, 0),
+	}
+
+	eventGraph := NewEventGraph(nodes,
+		NewLinkDelays(fixedDelay(100*time.Millisecond), 1),
+		100*time.Millisecond, 90*time.Second)
+
+	mMgr := &floodManager{
+		messages: map[int][]Message{
+			0: {&ChannelUpdate{id: 1, Node: nodeA, chanID: "chan1"}},
+			1: {&ChannelUpdate{id: 2, Node: nodeB, chanID: "chan2"}},
+		},
+		lastBucket: 1,
+	}
+
+	// M1 has been relayed by step 1, and nothing happens until the next
+	// tick of messages at step 900 apart from A's rotation at step 10.
+	var steps []int
+	for eventGraph.StepCount <= 10 {
+		steps = append(steps, eventGraph.StepCount)
+
+		_, err := eventGraph.Tick(dbc, mMgr)
+		require.NoError(t, err)
+	}
+
+	require.Contains(t, steps, 10)
+	require.Equal(t, []string{nodeC}, nodes[nodeA].(*SyncerNode).active)
+}
+
+func TestEventOrigin(t *testing.T) {
+	dbc := connectAndResetForTesting(t)
+
+	nodeA, nodeB := "nodeA", "nodeB"
+
+	// A ---- B
+	nodes := map[string]Node{
+		nodeA: MakeFloodNode(nodeA, []string{nodeB}),
+		nodeB: MakeFloodNode(nodeB, []string{nodeA}),
+	}
+
+	eventGraph := NewEventGraph(nodes,
+		NewLinkDelays(fixedDelay(250*time.Millisecond), 1),
+		100*time.Millisecond, 90*time.Second)
+
+	start := time.Unix(1000, 0)
+	mMgr := &floodManager{
+		messages: map[int][]Message{
+			0: {&ChannelUpdate{id: 1, Node: nodeA, chanID: "chan1",
+				ts: start.Add(30 * time.Second)}},
+			1: {&ChannelUpdate{id: 2, Node: nodeA, chanID: "chan2",
+				ts: start.Add(100 * time.Second)}},
+		},
+		lastBucket: 1,
+		start:      start,
+	}
+
+	// record the step at which A originates each message
+	originated := make(map[int64]int)
+	for {
+		step := eventGraph.StepCount
+		result, err := eventGraph.Tick(dbc, mMgr)
+		require.NoError(t, err)
+
+		for _, msg := range nodes[nodeA].GetMessages() {
+			if _, ok := originated[msg.UUID()]; !ok {
+				originated[msg.UUID()] = step
+			}
+		}
+
+		if result.done {
+			break
+		}
+	}
+
+	// Messages are originated at the step that their timestamp falls in,
+	// rather than at the start of their tick.
+	require.Equal(t, map[int64]int{1: 300, 2: 1000}, originated)
+}
+
+func TestDelayDistribution(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	dist, err := ParseDelayDistribution("fixed:200ms")
+	require.NoError(t, err)
+	require.Equal(t, 200*time.Millisecond, dist.Sample(r))
+
+	dist, err = ParseDelayDistribution("uniform:100ms-300ms")
+	require.NoError(t, err)
+	for i := 0; i < 100; i++ {
+		delay := dist.Sample(r)
+		require.GreaterOrEqual(t, delay, 100*time.Millisecond)
+		require.LessOrEqual(t, delay, 300*time.Millisecond)
+	}
+
+	dist, err = ParseDelayDistribution("exponential:1s")
+	require.NoError(t, err)
+	require.Equal(t, "exponential:1s", dist.String())
+
+	for _, bad := range []string{
+		"fixed", "fixed:-1s", "uniform:1s", "uniform:2s-1s", "normal:1s",
+	} {
+		_, err := ParseDelayDistribution(bad)
+		require.Error(t, err, bad)
+	}
+}
+
+func TestAddressDelays(t *testing.T) {
+	require.Equal(t, AddressUnknown, ClassifyAddresses(nil))
+	require.Equal(t, AddressClearnet, ClassifyAddresses([]string{
+		"1.2.3.4:9735", "[2001:db8::1]:9735",
+	}))
+	require.Equal(t, AddressOnion, ClassifyAddresses([]string{
+		"abcdefghijklmnop.onion:9735",
+	}))
+	require.Equal(t, AddressMixed, ClassifyAddresses([]string{
+		"1.2.3.4:9735", "abcdefghijklmnop.onion:9735",
+	}))
+
+	nodeA, nodeB, nodeC, nodeD := "nodeA", "nodeB", "nodeC", "nodeD"
+
+	// A and B are onion-only, C is mixed and D does not have addresses.
+	graph := NewGraphChannels()
+	graph.SetAddresses(nodeA, []string{"a.onion:9735"})
+	graph.SetAddresses(nodeB, []string{"b.onion:9735"})
+	graph.SetAddresses(nodeC, []string{"1.2.3.4:9735", "c.onion:9735"})
+
+	// A ---- B ---- C ---- D
+	nodes := map[string]Node{
+		nodeA: MakeFloodNode(nodeA, []string{nodeB}),
+		nodeB: MakeFloodNode(nodeB, []string{nodeA, nodeC}),
+		nodeC: MakeFloodNode(nodeC, []string{nodeB, nodeD}),
+		nodeD: MakeFloodNode(nodeD, []string{nodeC}),
+	}
+
+	addressDelays := &AddressDelays{
+		Clearnet:    fixedDelay(time.Millisecond),
+		TorClearnet: fixedDelay(time.Millisecond * 10),
+		Tor:         fixedDelay(time.Millisecond * 100),
+	}
+
+	delays := NewLinkDelays(fixedDelay(time.Second), 1)
+	addressDelays.Apply(delays, nodes, graph)
+
+	require.Equal(t, time.Millisecond*100, delays.Sample(nodeA, nodeB))
+	require.Equal(t, time.Millisecond*100, delays.Sample(nodeB, nodeA))
+	require.Equal(t, time.Millisecond*10, delays.Sample(nodeB, nodeC))
+	require.Equal(t, time.Millisecond*10, delays.Sample(nodeC, nodeB))
+	require.Equal(t, time.Millisecond, delays.Sample(nodeC, nodeD))
+	require.Equal(t, time.Millisecond, delays.Sample(nodeD, nodeC))
+
+	// Nodes that are not peers use the default delay.
+	require.Equal(t, time.Second, delays.Sample(nodeA, nodeD))
+}
+
+func TestParallelTick(t *testing.T) {
+	pubkeys := []string{
+		"nodeA", "nodeB", "nodeC", "nodeD", "nodeE", "nodeF", "nodeG",
+		"nodeH",
+	}
+
+	// Nodes are connected in a ring with chords across it. Half of the
+	// nodes are rate limited so that some messages are dropped, and the
+	// rest are epidemic nodes which make random choices.
+	makeNodes := func() map[string]Node {
+		nodes := make(map[string]Node)
+		for i, pubkey := range pubkeys {
+			peers := []string{
+				pubkeys[(i+1)%len(pubkeys)],
+				pubkeys[(i+len(pubkeys)-1)%len(pubkeys)],
+				pubkeys[(i+len(pubkeys)/2)%len(pubkeys)],
+			}
+
+			if i%2 == 1 {
+				nodes[pubkey] = MakeEpidemicNode(pubkey, peers, 2,
+					0.5, 1)
+				continue
+			}
+
+			node := MakeFloodNode(pubkey, peers)
+			node.(RateLimited).SetRateLimiter(NewTokenBucketLimiter(
+				TokenBucketConfig{Rate: 0.5, Burst: 1},
+				TokenBucketConfig{},
+			))
+			nodes[pubkey] = node
+		}
+
+		return nodes
+	}
+
+	start := time.Date(2019, 7, 10, 14, 0, 0, 0, time.UTC)
+	messages := make(map[int][]Message)
+	for i := 0; i < 24; i++ {
+		tick := i / 4
+		messages[tick] = append(messages[tick], &ChannelUpdate{
+			id:     int64(i + 1),
+			Node:   pubkeys[i%len(pubkeys)],
+			chanID: pubkeys[i%3],
+			ts:     start.Add(time.Duration(i) * time.Second),
+		})
+	}
+
+	run := func(workers int) ([]summary, [][2]int) {
+		dbc := connectAndResetForTesting(t)
+
+		chanGraph := NewChannelGraph(makeNodes())
+		chanGraph.Workers = workers
+
+		mMgr := &floodManager{
+			messages:   messages,
+			lastBucket: 5,
+		}
+
+		for {
+			result, err := chanGraph.Tick(dbc, mMgr)
+			require.NoError(t, err)
+
+			if result.done {
+				break
+			}
+		}
+
+		summaries, err := GetSummary(dbc)
+		require.NoError(t, err)
+		sort.Slice(summaries, func(i, j int) bool {
+			return summaries[i].messageID < summaries[j].messageID
+		})
+
+		var bandwidth [][2]int
+		for _, pubkey := range pubkeys {
+			sent, received, err := GetBandwidth(dbc, pubkey)
+			require.NoError(t, err)
+			bandwidth = append(bandwidth, [2]int{sent, received})
+		}
+
+		return summaries, bandwidth
+	}
+
+	summaries, bandwidth := run(1)
+	require.Len(t, summaries, 24)
+
+	for _, workers := range []int{2, 4, 16} {
+		parallelSummaries, parallelBandwidth := run(workers)
+		require.Equal(t, summaries, parallelSummaries, workers)
+		require.Equal(t, bandwidth, parallelBandwidth, workers)
+	}
+}
+
+// TestEpidemicPullRecovers tests that a node which pulled before any messages
+// were in circulation, and is then missed by pushes, pulls again and catches
+// up on the message it was missed for.
+func TestEpidemicPullRecovers(t *testing.T) {
+	nodeA, nodeB, nodeC := "nodeA", "nodeB", "nodeC"
+
+	// B ---- A ---- C
+	// With a fanout of one, A only pushes its message to one of B and C.
+	nodes := map[string]Node{
+		nodeA: MakeEpidemicNode(nodeA, []string{nodeB, nodeC}, 1, 1, 1),
+		nodeB: MakeEpidemicNode(nodeB, []string{nodeA}, 1, 1, 1),
+		nodeC: MakeEpidemicNode(nodeC, []string{nodeA}, 1, 1, 1),
+	}
+
+	// Every node's first pull round has found nothing by the time A
+	// originates its message.
+	mMgr := &floodManager{
+		messages: map[int][]Message{
+			4: {&ChannelUpdate{id: 1, Node: nodeA, chanID: "chan1"}},
+		},
+		lastBucket: 4,
+	}
+
+	dbc := connectAndResetForTesting(t)
+	chanGraph := NewChannelGraph(nodes)
+
+	for i := 0; ; i++ {
+		require.Less(t, i, 100, "simulation did not finish")
+
+		result, err := chanGraph.Tick(dbc, mMgr)
+		require.NoError(t, err)
+
+		if result.done {
+			break
+		}
+	}
+
+	for pubkey, node := range nodes {
+		require.Len(t, node.GetMessages(), 1, pubkey)
+	}
+}
+
+// TestSeededRun tests that runs with the same seed send messages in the
+// same order and produce the same results.
+func TestSeededRun(t *testing.T) {
+	pubkeys := []string{"nodeA", "nodeB", "nodeC", "nodeD", "nodeE", "nodeF"}
+
+	makeNodes := func(seed int64) map[string]Node {
+		nodes := make(map[string]Node)
+		for i, pubkey := range pubkeys {
+			peers := []string{
+				pubkeys[(i+1)%len(pubkeys)],
+				pubkeys[(i+len(pubkeys)-1)%len(pubkeys)],
+				pubkeys[(i+len(pubkeys)/2)%len(pubkeys)],
+			}
+
+			nodes[pubkey] = MakeEpidemicNode(pubkey, peers, 2, 0.5,
+				seed)
+		}
+
+		return nodes
+	}
+
+	start := time.Date(2019, 7, 10, 14, 0, 0, 0, time.UTC)
+	messages := make(map[int][]Message)
+	for i := 0; i < 12; i++ {
+		tick := i / 4
+		messages[tick] = append(messages[tick], &ChannelUpdate{
+			id:     int64(i + 1),
+			Node:   pubkeys[i%len(pubkeys)],
+			chanID: pubkeys[i%3],
+			ts:     start.Add(time.Duration(i) * time.Second),
+		})
+	}
+
+	run := func(seed int64) ([]string, []summary) {
+		dbc := connectAndResetForTesting(t)
+
+		chanGraph := NewChannelGraph(makeNodes(seed))
+		chanGraph.SetSeed(seed)
+		order := append([]string(nil), chanGraph.pubkeys...)
+
+		mMgr := &floodManager{
+			messages:   messages,
+			lastBucket: 2,
+		}
+
+		for {
+			result, err := chanGraph.Tick(dbc, mMgr)
+			require.NoError(t, err)
+
+			if result.done {
+				break
+			}
+		}
+
+		summaries, err := GetSummary(dbc)
+		require.NoError(t, err)
+
+		return order, summaries
+	}
+
+	order, summaries := run(7)
+	require.Len(t, summaries, 12)
+
+	sorted := append([]string(nil), order...)
+	sort.Strings(sorted)
+	require.Equal(t, pubkeys, sorted)
+
+	for i := 0; i < 3; i++ {
+		repeatOrder, repeatSummaries := run(7)
+		require.Equal(t, order, repeatOrder)
+		require.Equal(t, summaries, repeatSummaries)
+	}
+
+	otherOrder, _ := run(8)
+	require.NotEqual(t, order, otherOrder)
+}
+
+func TestChurn(t *testing.T) {
+	nodeA, nodeB, nodeC := "nodeA", "nodeB", "nodeC"
+	start := time.Date(2019, 7, 10, 14, 0, 0, 0, time.UTC)
+
+	// C is offline for ticks 1 and 2.
+	schedule, err := ReadUptimeSchedule(strings.NewReader(
+		"node_id,offline_tick,online_tick\nnodeC,1,3\n",
+	))
+	require.NoError(t, err)
+
+	tests := []struct {
+		name string
+		sync ReconnectSync
+
+		// caughtUp is the tick that C receives M1, which it missed
+		// while it was offline.
+		caughtUp int
+	}{
+		{
+			// Tick 3: C(b.M2) and queries B
+			// Tick 4: B(c.query_channel_range)
+			// Tick 5: C(b.reply_channel_range)
+			// Tick 6: B(c.query_short_channel_ids)
+			// Tick 7: C(b.M1)
+			name:     "query",
+			sync:     SyncQuery,
+			caughtUp: 7,
+		},
+		{
+			// Tick 3: C(b.M2) and sends B a filter
+			// Tick 4: B(c.gossip_timestamp_filter)
+			// Tick 5: C(b.M1)
+			name:     "filter",
+			sync:     SyncFilter,
+			caughtUp: 5,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dbc := connectAndResetForTesting(t)
+
+			// A ---- B ---- C
+			nodes := map[string]Node{
+				nodeA: MakeFloodNode(nodeA, []string{nodeB}),
+				nodeB: MakeFloodNode(nodeB, []string{nodeA, nodeC}),
+				nodeC: MakeFloodNode(nodeC, []string{nodeB}),
+			}
+
+			chanGraph := NewChannelGraph(nodes)
+			chanGraph.Churn = NewChurn(schedule, test.sync)
+
+			mMgr := &floodManager{
+				messages: map[int][]Message{
+					0: {&ChannelUpdate{
+						id: 1, Node: nodeA, chanID: "chan1",
+						ts: start,
+					}},
+					1: {&ChannelUpdate{
+						id: 2, Node: nodeA, chanID: "chan2",
+						ts: start.Add(time.Minute),
+					}},
+					2: {&ChannelUpdate{
+						id: 3, Node: nodeC, chanID: "chan3",
+						ts: start.Add(2 * time.Minute),
+					}},
+				},
+				lastBucket: 2,
+			}
+
+			for {
+				result, err := chanGraph.Tick(dbc, mMgr)
+				require.NoError(t, err)
+
+				if result.done {
+					break
+				}
+			}
+
+			// Tick 0: A(M1*)
+			// Tick 1: B(a.M1), C goes offline
+			// Tick 2: B drops M1 for C, C drops M3*
+			// Tick 3: C comes back online
+			latency, err := GetMessageLatency(dbc, 1)
+			require.NoError(t, err)
+			require.Equal(t, test.caughtUp, latency)
+
+			dropped, err := GetDroppedCount(dbc, 1)
+			require.NoError(t, err)
+			require.Equal(t, 1, dropped)
+
+			// C is offline when it creates M3, so nobody sees it.
+			dropped, err = GetDroppedCount(dbc, 3)
+			require.NoError(t, err)
+			require.Equal(t, 1, dropped)
+
+			_, err = GetMessageLatency(dbc, 3)
+			require.Error(t, err)
+
+			// C was missing M1 and M2 when it came back online.
+			outages, stale, err := GetStaleness(dbc, nodeC)
+			require.NoError(t, err)
+			require.Equal(t, 1, outages)
+			require.Equal(t, 2, stale)
+		})
+	}
+
+	// Nodes that run exchanges with their peers must give them up when a
+	// peer goes offline, or they wait for it forever and the simulation
+	// never ends. Half of the nodes in a ring go offline at random.
+	pubkeys := []string{
+		"nodeA", "nodeB", "nodeC", "nodeD", "nodeE", "nodeF",
+	}
+
+	protocols := []struct {
+		name     string
+		makeNode func(pubkey string, peers []string) Node
+	}{
+		{
+			name: "recon",
+			makeNode: func(pubkey string, peers []string) Node {
+				return MakeReconNode(pubkey, peers, 2,
+					ErlayCapacity(1))
+			},
+		},
+		{
+			name: "hybrid",
+			makeNode: func(pubkey string, peers []string) Node {
+				return MakeHybridNode(pubkey, peers, 1, 2,
+					ErlayCapacity(1))
+			},
+		},
+		{
+			name:     "inv",
+			makeNode: MakeInvNode,
+		},
+		{
+			name:     "flood",
+			makeNode: MakeFloodNode,
+		},
+		{
+			name: "syncer",
+			makeNode: func(pubkey string, peers []string) Node {
+				return MakeSyncerNode(pubkey, peers, 1,
+					minRotationInterval)
+			},
+		},
+		{
+			name: "epidemic",
+			makeNode: func(pubkey string, peers []string) Node {
+				return MakeEpidemicNode(pubkey, peers, 1, 0.5, 1)
+			},
+		},
+	}
+
+	for _, protocol := range protocols {
+		t.Run(protocol.name, func(t *testing.T) {
+			dbc := connectAndResetForTesting(t)
+
+			nodes := make(map[string]Node)
+			for i, pubkey := range pubkeys {
+				nodes[pubkey] = protocol.makeNode(pubkey, []string{
+					pubkeys[(i+1)%len(pubkeys)],
+					pubkeys[(i+len(pubkeys)-1)%len(pubkeys)],
+				})
+			}
+
+			chanGraph := NewChannelGraph(nodes)
+			chanGraph.Churn = NewChurn(
+				NewChurnModel(pubkeys, 0.5, 3, 2, 1), SyncQuery,
+			)
+
+			messages := make(map[int][]Message)
+			for i := 0; i < 12; i++ {
+				tick := i / 2
+				messages[tick] = append(messages[tick],
+					&ChannelUpdate{
+						id:     int64(i + 1),
+						Node:   pubkeys[i%len(pubkeys)],
+						chanID: fmt.Sprintf("chan%v", i),
+						ts: start.Add(
+							time.Duration(i) * time.Second,
+						),
+					})
+			}
+			mMgr := &floodManager{
+				messages:   messages,
+				lastBucket: 5,
+			}
+
+			var (
+				done    bool
+				offline int
+			)
+			for i := 0; i < 1000 && !done; i++ {
+				result, err := chanGraph.Tick(dbc, mMgr)
+				require.NoError(t, err)
+
+				offline += result.churn.offline
+				done = result.done
+			}
+			require.True(t, done, "simulation did not end")
+			require.Greater(t, offline, 0)
+
+			// No node is left waiting on a peer.
+			for _, pubkey := range pubkeys {
+				switch n := nodes[pubkey].(type) {
+				case *ReconNode:
+					require.Empty(t, n.initiated, pubkey)
+					require.Empty(t, n.inFlight, pubkey)
+
+				case *HybridNode:
+					require.Empty(t, n.initiated, pubkey)
+					require.Empty(t, n.inFlight, pubkey)
+
+				case *EpidemicNode:
+					require.False(t, n.awaitingPull, pubkey)
+
+				case *InvNode:
+					require.Empty(t, n.requested, pubkey)
+
+				// every node is back online, so each node
+				// has an active syncer again
+				case *SyncerNode:
+					require.Empty(t, n.disconnected, pubkey)
+					require.Len(t, n.active, 1, pubkey)
+				}
+			}
+		})
+	}
+}
+
+// TestChurnDrop tests that only the gossip messages an offline node misses
+// are recorded and counted as dropped.
+func TestChurnDrop(t *testing.T) {
+	dbc := connectAndResetForTesting(t)
+
+	churn := NewChurn(fileSchedule{}, SyncQuery)
+
+	dropped, err := churn.Drop(dbc, "nodeA", []Message{
+		&queryChannelRange{},
+		&ChannelUpdate{id: 1, Node: "nodeB", chanID: "chan1"},
+		&gossipTimestampFilter{filter: AllGossip},
+	}, 0)
+	require.NoError(t, err)
+	require.Equal(t, 1, dropped)
+
+	count, err := GetDroppedCount(dbc, 1)
+	require.NoError(t, err)
+	require.Equal(t, 1, count)
+}
+
+// TestChurnPeerState tests that flood and syncer nodes reset the state they
+// keep for a peer when it goes offline.
+func TestChurnPeerState(t *testing.T) {
+	nodeA, nodeB, nodeC := "nodeA", "nodeB", "nodeC"
+
+	run := func(t *testing.T, nodes map[string]Node, schedule string,
+		messages map[int][]Message) []*tickResult {
+
+		dbc := connectAndResetForTesting(t)
+
+		uptime, err := ReadUptimeSchedule(strings.NewReader(schedule))
+		require.NoError(t, err)
+
+		chanGraph := NewChannelGraph(nodes)
+		chanGraph.Churn = NewChurn(uptime, SyncQuery)
+
+		mMgr := &floodManager{
+			messages:   messages,
+			lastBucket: 4,
+		}
+
+		var results []*tickResult
+		for i := 0; ; i++ {
+			require.Less(t, i, 100, "simulation did not finish")
+
+			result, err := chanGraph.Tick(dbc, mMgr)
+			require.NoError(t, err)
+			results = append(results, result)
+
+			if result.done {
+				return results
+			}
+		}
+	}
+
+	t.Run("flood", func(t *testing.T) {
+		// A ---- B
+		nodes := map[string]Node{
+			nodeA: MakeFloodNode(nodeA, []string{nodeB}),
+			nodeB: MakeFloodNode(nodeB, []string{nodeA}),
+		}
+
+		// B has turned gossip off for A, and A queries B just before
+		// B goes offline for ticks 1 and 2.
+		flood := nodes[nodeA].(*FloodNode)
+		flood.SetPeerFilter(nodeB, NoGossip)
+		flood.QueryPeer(nodeB)
+
+		results := run(t, nodes, "nodeB,1,3\n", map[int][]Message{
+			4: {&ChannelUpdate{id: 1, Node: nodeA, chanID: "chan1"}},
+		})
+
+		// The query is lost with the connection rather than dropped.
+		require.Zero(t, results[1].churn.dropped)
+
+		// B's filter ended with its connection, so A relays it M1.
+		require.Len(t, nodes[nodeB].GetMessages(), 1)
+	})
+
+	t.Run("syncer", func(t *testing.T) {
+		// B ---- A ---- C
+		nodes := map[string]Node{
+			nodeA: MakeSyncerNode(nodeA, []string{nodeB, nodeC}, 1, 0),
+			nodeB: MakeSyncerNode(nodeB, []string{nodeA}, 1, 0),
+			nodeC: MakeSyncerNode(nodeC, []string{nodeA}, 1, 0),
+		}
+
+		// B, A's active syncer, is offline while C creates M1.
+		run(t, nodes, "nodeB,1,10\n", map[int][]Message{
+			2: {&ChannelUpdate{id: 1, Node: nodeC, chanID: "chan1"}},
+		})
+
+		// A made C its active syncer when B went offline, and kept it
+		// when B came back.
+		syncer := nodes[nodeA].(*SyncerNode)
+		require.Equal(t, []string{nodeC}, syncer.active)
+		require.Len(t, nodes[nodeA].GetMessages(), 1)
+		require.Len(t, nodes[nodeB].GetMessages(), 1)
+	})
+}
+
+// TestFloodNodeDisconnect tests that a flood node forgets a peer's timestamp
+// filter and the gossip queries queued for it when the peer disconnects.
+func TestFloodNodeDisconnect(t *testing.T) {
+	dbc := connectAndResetForTesting(t)
+
+	nodeA, nodeB := "nodeA", "nodeB"
+	node := MakeFloodNode(nodeA, []string{nodeB}).(*FloodNode)
+
+	// B turns gossip off, and we query it.
+	node.SetPeerFilter(nodeB, NoGossip)
+	node.QueryPeer(nodeB)
+
+	node.PeerDisconnected(nodeB)
+	node.PeerConnected(nodeB)
+
+	// B has not sent a filter since it reconnected, so it is relayed
+	// every message, and the query is not sent.
+	msg := &ChannelUpdate{id: 1, Node: nodeA, chanID: "chan1"}
+	require.NoError(t, node.ReceiveMessage(dbc, msg, 0, nodeA))
+
+	node.ProgressQueue()
+	require.Equal(t, map[string][]Message{nodeB: {msg}}, node.GetQueue())
+}
+
+// TestSyncerNodeDisconnect tests that a syncer node replaces an active syncer
+// that disconnects, and sends a filter to it when it reconnects.
+func TestSyncerNodeDisconnect(t *testing.T) {
+	nodeA, nodeB, nodeC := "nodeA", "nodeB", "nodeC"
+	node := MakeSyncerNode("node", []string{nodeA, nodeB, nodeC}, 1,
+		0).(*SyncerNode)
+
+	node.ProgressQueue()
+	require.Equal(t, []string{nodeA}, node.active)
+
+	// A disconnects, so B is made active and synced with.
+	node.PeerDisconnected(nodeA)
+	require.Equal(t, []string{nodeB}, node.active)
+
+	node.ProgressQueue()
+	require.Equal(t, map[string][]Message{
+		nodeB: {
+			&gossipTimestampFilter{filter: AllGossip},
+			&queryChannelRange{},
+		},
+	}, node.GetQueue())
+
+	// A is passive when it reconnects.
+	node.PeerConnected(nodeA)
+	node.ProgressQueue()
+	require.Equal(t, map[string][]Message{
+		nodeA: {&gossipTimestampFilter{filter: NoGossip}},
+	}, node.GetQueue())
+	require.Equal(t, []string{nodeB}, node.active)
+}
+
+func TestUptimeSchedule(t *testing.T) {
+	schedule, err := ReadUptimeSchedule(strings.NewReader(
+		"nodeA,10,12\nnodeB,3,4\nnodeA,2,5\n",
+	))
+	require.NoError(t, err)
+	require.Equal(t, []string{"nodeA", "nodeB"}, schedule.Nodes())
+
+	outage, ok := schedule.NextOutage("nodeA", 0)
+	require.True(t, ok)
+	require.Equal(t, Outage{Start: 2, End: 5}, outage)
+
+	outage, ok = schedule.NextOutage("nodeA", 5)
+	require.True(t, ok)
+	require.Equal(t, Outage{Start: 10, End: 12}, outage)
+
+	_, ok = schedule.NextOutage("nodeA", 12)
+	require.False(t, ok)
+
+	_, err = ReadUptimeSchedule(strings.NewReader("nodeA,2,5\nnodeA,4,6\n"))
+	require.Error(t, err)
+
+	_, err = ReadUptimeSchedule(strings.NewReader("nodeA,5,5\n"))
+	require.Error(t, err)
+
+	// Schedules of 90 second ticks are run in 100ms steps by the event
+	// engine.
+	scaled := schedule.(fileSchedule).scale(90*time.Second,
+		100*time.Millisecond)
+	outage, ok = scaled.NextOutage("nodeB", 0)
+	require.True(t, ok)
+	require.Equal(t, Outage{Start: 2700, End: 3600}, outage)
+
+	var pubkeys []string
+	for i := 0; i < 10; i++ {
+		pubkeys = append(pubkeys, fmt.Sprintf("node%v", i))
+	}
+
+	model := NewChurnModel(pubkeys, 0.3, 20, 5, 1)
+	require.Len(t, model.Nodes(), 3)
+
+	// The same seed picks the same nodes and outages.
+	other := NewChurnModel(pubkeys, 0.3, 20, 5, 1)
+	require.Equal(t, model.Nodes(), other.Nodes())
+
+	for _, pubkey := range model.Nodes() {
+		tick := 0
+		for i := 0; i < 10; i++ {
+			outage, ok := model.NextOutage(pubkey, tick)
+			require.True(t, ok)
+			require.Greater(t, outage.Start, tick)
+			require.Greater(t, outage.End, outage.Start)
+
+			otherOutage, _ := other.NextOutage(pubkey, tick)
+			require.Equal(t, outage, otherOutage)
+
+			tick = outage.End
+		}
+	}
+
+	_, ok = model.NextOutage("unknown", 0)
+	require.False(t, ok)
 }
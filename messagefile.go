@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Message types used in message files.
+const (
+	recordChannelUpdate       = "channel_update"
+	recordChannelAnnouncement = "channel_announcement"
+	recordNodeAnnouncement    = "node_announcement"
+
+	// recordStart is a header record which holds the time that the
+	// first tick of the file starts at in its timestamp.
+	recordStart = "start"
+)
+
+// csvHeader is the header row of a CSV message file. Origin nodes are
+// separated by semicolons.
+var csvHeader = []string{
+	"uuid", "type", "id", "origin_nodes", "timestamp", "byte_len",
+	"channel_flags", "message_flags",
+}
+
+// messageRecord is a message as it is stored in a message file, one message
+// per line. The ID is the short channel ID for channel messages and the
+// node's pubkey for node announcements. Flags are only set for channel
+// updates.
+type messageRecord struct {
+	UUID         int64     `json:"uuid"`
+	Type         string    `json:"type"`
+	ID           string    `json:"id"`
+	OriginNodes  []string  `json:"origin_nodes"`
+	Timestamp    time.Time `json:"timestamp"`
+	ByteLen      int       `json:"byte_len"`
+	ChannelFlags int       `json:"channel_flags,omitempty"`
+	MessageFlags int       `json:"message_flags,omitempty"`
+}
+
+// newMessageRecord returns the record for a message.
+func newMessageRecord(msg Message) (*messageRecord, error) {
+	record := &messageRecord{
+		UUID:        msg.UUID(),
+		OriginNodes: msg.OriginNodes(),
+		Timestamp:   msg.TimeStamp(),
+		ByteLen:     msg.Size(),
+	}
+
+	switch m := msg.(type) {
+	case *ChannelUpdate:
+		record.Type = recordChannelUpdate
+		record.ID = m.chanID
+		record.ChannelFlags, record.MessageFlags = m.flags()
+
+	case *ChannelAnnouncement:
+		record.Type = recordChannelAnnouncement
+		record.ID = m.chanID
+
+	case *NodeAnnouncement:
+		record.Type = recordNodeAnnouncement
+		record.ID = m.Node
+
+	default:
+		return nil, fmt.Errorf("cannot write message type: %T", msg)
+	}
+
+	return record, nil
+}
+
+// message returns the message a record holds.
+func (r *messageRecord) message() (Message, error) {
+	switch r.Type {
+	case recordChannelUpdate:
+		if len(r.OriginNodes) != 1 {
+			return nil, fmt.Errorf("channel update %v has %v origin "+
+				"nodes", r.UUID, len(r.OriginNodes))
+		}
+
+		update := &ChannelUpdate{
+			id:      r.UUID,
+			Node:    r.OriginNodes[0],
+			ts:      r.Timestamp,
+			chanID:  r.ID,
+			byteLen: r.ByteLen,
+		}
+		update.setFlags(r.ChannelFlags, r.MessageFlags)
+
+		return update, nil
+
+	case recordChannelAnnouncement:
+		if len(r.OriginNodes) != 2 {
+			return nil, fmt.Errorf("channel announcement %v has %v "+
+				"origin nodes", r.UUID, len(r.OriginNodes))
+		}
+
+		return &ChannelAnnouncement{
+			id:      r.UUID,
+			Node1:   r.OriginNodes[0],
+			Node2:   r.OriginNodes[1],
+			ts:      r.Timestamp,
+			chanID:  r.ID,
+			byteLen: r.ByteLen,
+		}, nil
+
+	case recordNodeAnnouncement:
+		return &NodeAnnouncement{
+			id:      r.UUID,
+			Node:    r.ID,
+			ts:      r.Timestamp,
+			byteLen: r.ByteLen,
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown message type: %v", r.Type)
+	}
+}
+
+func (r *messageRecord) csvRow() []string {
+	return []string{
+		strconv.FormatInt(r.UUID, 10),
+		r.Type,
+		r.ID,
+		strings.Join(r.OriginNodes, ";"),
+		r.Timestamp.Format(time.RFC3339Nano),
+		strconv.Itoa(r.ByteLen),
+		strconv.Itoa(r.ChannelFlags),
+		strconv.Itoa(r.MessageFlags),
+	}
+}
+
+func parseCSVRow(row []string) (*messageRecord, error) {
+	if len(row) != len(csvHeader) {
+		return nil, fmt.Errorf("expected %v columns, got %v",
+			len(csvHeader), len(row))
+	}
+
+	uuid, err := strconv.ParseInt(row[0], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	ts, err := time.Parse(time.RFC3339Nano, row[4])
+	if err != nil {
+		return nil, err
+	}
+
+	byteLen, err := strconv.Atoi(row[5])
+	if err != nil {
+		return nil, err
+	}
+
+	chanFlags, err := strconv.Atoi(row[6])
+	if err != nil {
+		return nil, err
+	}
+
+	msgFlags, err := strconv.Atoi(row[7])
+	if err != nil {
+		return nil, err
+	}
+
+	record := &messageRecord{
+		UUID:         uuid,
+		Type:         row[1],
+		ID:           row[2],
+		Timestamp:    ts,
+		ByteLen:      byteLen,
+		ChannelFlags: chanFlags,
+		MessageFlags: msgFlags,
+	}
+	if row[3] != "" {
+		record.OriginNodes = strings.Split(row[3], ";")
+	}
+
+	return record, nil
+}
+
+// isCSV returns true if a message file should be read and written as CSV
+// rather than JSON lines.
+func isCSV(path string) bool {
+	return strings.ToLower(filepath.Ext(path)) == ".csv"
+}
+
+// messageWriter writes messages to a message file.
+type messageWriter struct {
+	buffered    *bufio.Writer
+	csvWriter   *csv.Writer
+	jsonEncoder *json.Encoder
+}
+
+// newMessageWriter returns a writer which writes messages to w, as CSV if
+// csvFormat is set and otherwise as JSON lines.
+func newMessageWriter(w io.Writer, csvFormat bool) (*messageWriter, error) {
+	buffered := bufio.NewWriter(w)
+	writer := &messageWriter{
+		buffered: buffered,
+	}
+
+	if !csvFormat {
+		writer.jsonEncoder = json.NewEncoder(buffered)
+		return writer, nil
+	}
+
+	writer.csvWriter = csv.NewWriter(buffered)
+	if err := writer.csvWriter.Write(csvHeader); err != nil {
+		return nil, err
+	}
+
+	return writer, nil
+}
+
+// writeStart adds a header record with the time that the first tick of the
+// file starts at.
+func (w *messageWriter) writeStart(start time.Time) error {
+	record := &messageRecord{
+		Type:      recordStart,
+		Timestamp: start,
+	}
+
+	if w.csvWriter != nil {
+		return w.csvWriter.Write(record.csvRow())
+	}
+
+	return w.jsonEncoder.Encode(record)
+}
+
+// write adds messages to the file.
+func (w *messageWriter) write(messages []Message) error {
+	for _, msg := range messages {
+		record, err := newMessageRecord(msg)
+		if err != nil {
+			return err
+		}
+
+		if w.csvWriter != nil {
+			err = w.csvWriter.Write(record.csvRow())
+		} else {
+			err = w.jsonEncoder.Encode(record)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// flush writes any buffered messages.
+func (w *messageWriter) flush() error {
+	if w.csvWriter != nil {
+		w.csvWriter.Flush()
+		if err := w.csvWriter.Error(); err != nil {
+			return err
+		}
+	}
+
+	return w.buffered.Flush()
+}
+
+// WriteMessages writes messages to w, as CSV if csvFormat is set and
+// otherwise as JSON lines.
+func WriteMessages(w io.Writer, messages []Message, csvFormat bool) error {
+	writer, err := newMessageWriter(w, csvFormat)
+	if err != nil {
+		return err
+	}
+
+	if err := writer.write(messages); err != nil {
+		return err
+	}
+
+	return writer.flush()
+}
+
+// ReadMessages reads messages from r, as CSV if csvFormat is set and
+// otherwise as JSON lines.
+func ReadMessages(r io.Reader, csvFormat bool) ([]Message, error) {
+	messages, _, err := readMessageFile(r, csvFormat)
+	return messages, err
+}
+
+// readMessageFile reads messages from r, along with the time that the first
+// tick starts at if the file has a start record, and the zero time if it does
+// not.
+func readMessageFile(r io.Reader, csvFormat bool) ([]Message, time.Time,
+	error) {
+
+	var records []*messageRecord
+
+	if csvFormat {
+		rows, err := csv.NewReader(r).ReadAll()
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+
+		// skip the header row
+		for i, row := range rows {
+			if i == 0 && len(row) > 0 && row[0] == csvHeader[0] {
+				continue
+			}
+
+			record, err := parseCSVRow(row)
+			if err != nil {
+				return nil, time.Time{}, fmt.Errorf("row %v: %v",
+					i+1, err)
+			}
+			records = append(records, record)
+		}
+	} else {
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(nil, 1<<20)
+
+		var line int
+		for scanner.Scan() {
+			line++
+			if strings.TrimSpace(scanner.Text()) == "" {
+				continue
+			}
+
+			var record messageRecord
+			err := json.Unmarshal(scanner.Bytes(), &record)
+			if err != nil {
+				return nil, time.Time{}, fmt.Errorf("line %v: "+
+					"%v", line, err)
+			}
+			records = append(records, &record)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, time.Time{}, err
+		}
+	}
+
+	var (
+		start    time.Time
+		messages = make([]Message, 0, len(records))
+	)
+	for _, record := range records {
+		if record.Type == recordStart {
+			start = record.Timestamp
+			continue
+		}
+
+		msg, err := record.message()
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		messages = append(messages, msg)
+	}
+
+	return messages, start, nil
+}
+
+// NewFileMessageManager returns a message manager with the messages in a
+// message file. Files ending in .csv are read as CSV, and all others as JSON
+// lines. Messages are bucketed into ticks from the start time in the file's
+// start record, or from the earliest timestamp in the file if it does not
+// have one, and keep their order in the file within a tick.
+func NewFileMessageManager(path string, tick time.Duration) (MessageManager, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	messages, startTime, err := readMessageFile(file, isCSV(path))
+	if err != nil {
+		return nil, err
+	}
+
+	if startTime.IsZero() {
+		for i, msg := range messages {
+			if i == 0 || msg.TimeStamp().Before(startTime) {
+				startTime = msg.TimeStamp()
+			}
+		}
+	}
+
+	log.Printf("Read in %v messages from %v", len(messages), path)
+
+	return bucketMessages(messages, startTime, tick), nil
+}
+
+// ExportMessages writes the messages between the start time and the end of
+// the duration in the wirewatcher DB to a message file, removing duplicate
+// updates with the dedup strategy provided. The file starts with a record of
+// the start time, so that it is replayed in the same ticks. Messages are
+// streamed to the file one tick at a time, in the order that the simulation
+// would release them.
+func ExportMessages(path string, startTime time.Time, duration,
+	tick time.Duration, dedup DedupStrategy) error {
+
+	mgr, err := NewFloodMessageManager(startTime, duration, tick, dedup)
+	if err != nil {
+		return err
+	}
+	defer mgr.close()
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer, err := newMessageWriter(file, isCSV(path))
+	if err != nil {
+		return err
+	}
+
+	if err := writer.writeStart(startTime); err != nil {
+		return err
+	}
+
+	var count int
+	for i := 0; ; i++ {
+		messages, done := mgr.GetNewMessages(i)
+		if err := mgr.Err(); err != nil {
+			return err
+		}
+
+		if err := writer.write(messages); err != nil {
+			return err
+		}
+		count += len(messages)
+
+		if done {
+			break
+		}
+	}
+
+	if err := writer.flush(); err != nil {
+		return err
+	}
+
+	log.Printf("Exported %v messages to %v", count, path)
+
+	return file.Close()
+}
@@ -1,17 +1,11 @@
 package main
 
 import (
-	"database/sql"
-	"flag"
+	"fmt"
 	"log"
-	"math"
 	"time"
 )
 
-var wirewatcher = flag.String("wirewatcher_db",
-	"mysql://root@unix("+SockFile+")/wirewatcher?",
-	"uri for wirewatcher DB")
-
 type Message interface {
 	// UUID is a unique ID given to the message during data gathering
 	// to allow for easy correlation of LN messages and underlying detail.
@@ -27,12 +21,46 @@ type Message interface {
 
 	// Timestamp of message.
 	TimeStamp() time.Time
+
+	// Size of the message on the wire in bytes.
+	Size() int
+}
+
+// controlMessage provides a Message implementation for protocol messages
+// which do not carry gossip themselves, such as the messages that nodes use
+// to reconcile their sets of gossip. They are never reported in the metrics
+// store.
+type controlMessage struct{}
+
+func (controlMessage) UUID() int64 {
+	return 0
+}
+
+func (controlMessage) ID() string {
+	return ""
+}
+
+func (controlMessage) OriginNodes() []string {
+	return nil
+}
+
+func (controlMessage) TimeStamp() time.Time {
+	return time.Time{}
+}
+
+// Size returns zero, control messages override it with their wire size.
+func (controlMessage) Size() int {
+	return 0
 }
 
 type floodManager struct {
 	// Buckets of messages based on tick index
 	messages   map[int][]Message
 	lastBucket int
+
+	// start is the time that the first bucket starts at, it is zero if
+	// it is not known.
+	start time.Time
 }
 
 type MessageManager interface {
@@ -41,152 +69,162 @@ type MessageManager interface {
 	GetNewMessages(tick int) ([]Message, bool)
 }
 
-type dbChanUpdate struct {
-	id        int64
-	chanID    string
-	ts        time.Time
+// TimedMessageManager is implemented by message managers that know the time
+// that their first tick starts at, so that engines can originate messages at
+// their timestamp rather than at the start of their tick.
+type TimedMessageManager interface {
+	MessageManager
+
+	// StartTime returns the time that tick 0 starts at, or zero if it is
+	// not known.
+	StartTime() time.Time
+}
+
+// chanPolicy is the routing policy a channel update sets.
+type chanPolicy struct {
 	baseFee   int
 	feeRate   int
 	chanFlags int
+	msgFlags  int
 	maxHTLC   int
 	minHTLC   int
 	timeLock  int
 }
 
-func (u *dbChanUpdate) isDuplicate(update dbChanUpdate) bool {
-	// if updates are more than 5 minutes apart we do not consider them duplicates
-	if math.Abs(u.ts.Sub(update.ts).Seconds()) > (time.Minute * 5).Seconds() {
-		return false
-	}
+// dbChanUpdate is a channel update read from the wirewatcher DB, along with
+// the size of the message and the nodes of the channel that it updates.
+type dbChanUpdate struct {
+	chanPolicy
 
-	// if updates differ on any dimension they are not duplicates
-	if u.chanID != update.chanID ||
-		u.baseFee != update.baseFee ||
-		u.feeRate != update.feeRate ||
-		u.chanFlags != update.chanFlags ||
-		u.maxHTLC != update.maxHTLC ||
-		u.minHTLC != update.minHTLC ||
-		u.timeLock != update.timeLock {
-		return false
-	}
+	id      int64
+	chanID  string
+	ts      time.Time
+	byteLen int
+	node1   string
+	node2   string
+}
 
-	return true
+// bucketIndex returns the index of the tick that a timestamp falls in,
+// counting from the start time.
+func bucketIndex(ts, startTime time.Time, tick time.Duration) int {
+	return int(ts.Sub(startTime) / tick)
 }
 
-func NewFloodMessageManager(startTime time.Time, duration time.Duration) (MessageManager, error) {
-	dbc, err := connectWithURI(*wirewatcher)
-	if err != nil {
-		return nil, err
-	}
-	endTime := startTime.Add(duration)
-
-	rows, err := dbc.Query("select uuid, chan_id, `timestamp`, base_fee,"+
-		"fee_rate, channel_flags, max_htlc, min_htlc, timelock_delta"+
-		" from channel_updates where `timestamp`>=? and `timestamp`<=? "+
-		"order by timestamp",
-		startTime, endTime)
-	if err != nil {
-		return nil, err
+// bucketMessages returns a message manager which releases each message in
+// the tick that its timestamp falls in, counting from the start time.
+// Messages keep their order within a tick.
+func bucketMessages(messages []Message, startTime time.Time,
+	tick time.Duration) *floodManager {
+
+	var lastBucket int
+	buckets := make(map[int][]Message)
+
+	for _, msg := range messages {
+		bucket := bucketIndex(msg.TimeStamp(), startTime, tick)
+		if bucket >= lastBucket {
+			lastBucket = bucket
+		}
+		buckets[bucket] = append(buckets[bucket], msg)
 	}
 
-	recentUpdates := make(map[string]dbChanUpdate)
-	var uniqueUpdates []dbChanUpdate
+	log.Printf("Read in flood manager with: %v buckets containing"+
+		" %v messages", len(buckets), len(messages))
 
-	var count, uniqueCount int
+	return &floodManager{
+		messages:   buckets,
+		lastBucket: lastBucket,
+		start:      startTime,
+	}
+}
 
-	defer rows.Close()
-	for rows.Next() {
-		count++
+// channelAnnouncementPrefix is added to a channel announcement's short
+// channel ID to form its protocol ID, so that nodes do not confuse it with
+// updates for the channel.
+const channelAnnouncementPrefix = "announcement:"
 
-		var msg dbChanUpdate
-		err := rows.Scan(&msg.id, &msg.chanID, &msg.ts, &msg.baseFee,
-			&msg.feeRate, &msg.chanFlags, &msg.maxHTLC, &msg.minHTLC,
-			&msg.timeLock)
-		if err != nil {
-			return nil, err
-		}
+// ChannelAnnouncement is a channel_announcement, which is signed by and
+// originates from both of the channel's nodes.
+type ChannelAnnouncement struct {
+	id      int64
+	Node1   string
+	Node2   string
+	ts      time.Time
+	chanID  string
+	byteLen int
+}
 
-		// if we have no updates for this channel, it is not a duplicate and
-		// can be added to the set of
-		recent, ok := recentUpdates[msg.chanID]
-		if !ok {
-			uniqueCount++
-			uniqueUpdates = append(uniqueUpdates, msg)
-			recentUpdates[msg.chanID] = msg
-			continue
-		}
+func (c *ChannelAnnouncement) UUID() int64 {
+	return c.id
+}
 
-		// if we have an update for this channel already, only add the update
-		// to our unique list of updates if it is not a duplicate.
-		if !recent.isDuplicate(msg) {
-			uniqueCount++
-			uniqueUpdates = append(uniqueUpdates, msg)
-
-			// if the update is more recent than the one we have on record,
-			// replace it in the recentUpdates map which we use for duplicates.
-			if recent.ts.Before(msg.ts) {
-				recentUpdates[msg.chanID] = msg
-			}
-		}
+func (c *ChannelAnnouncement) OriginNodes() []string {
+	return []string{c.Node1, c.Node2}
+}
 
-	}
+// TimeStamp returns the time the announcement was first seen, since
+// announcements do not have a timestamp of their own.
+func (c *ChannelAnnouncement) TimeStamp() time.Time {
+	return c.ts
+}
 
-	log.Printf("Read in %v unique messages from %v messages", uniqueCount, count)
+func (c *ChannelAnnouncement) ID() string {
+	return channelAnnouncementPrefix + c.chanID
+}
 
-	var lastBucket int
-	count = 0
-	messages := make(map[int][]Message)
+func (c *ChannelAnnouncement) Size() int {
+	return c.byteLen
+}
 
-	for _, m := range uniqueUpdates {
-		var byteLen int
+// NodeAnnouncement is a node_announcement, which is identified by the pubkey
+// of the node that it announces.
+type NodeAnnouncement struct {
+	id        int64
+	Node      string
+	ts        time.Time
+	Alias     string
+	Addresses []string
+	byteLen   int
+}
 
-		err := dbc.QueryRow("select byte_len from ln_messages where "+
-			"uuid=?", m.id).Scan(&byteLen)
-		if err != nil {
-			return nil, err
-		}
+func (n *NodeAnnouncement) UUID() int64 {
+	return n.id
+}
 
-		var node1, node2 string
-		err = dbc.QueryRow("select node_1, node_2 from "+
-			"channel_announcements where chan_id=? limit 1", m.chanID).Scan(&node1, &node2)
-		if err == sql.ErrNoRows {
-			// we can reasonably expect that we do not have the announcement for
-			// very old channels, so just skip message
-			log.Printf("Cannot find channel announcment for message: %v", m.id)
-			continue
-		} else if err != nil {
-			return nil, err
-		}
+func (n *NodeAnnouncement) OriginNodes() []string {
+	return []string{n.Node}
+}
 
-		msg := &ChannelUpdate{
-			id:      m.id,
-			Node:    node1,
-			ts:      m.ts,
-			chanID:  m.chanID,
-			byteLen: byteLen,
-		}
+func (n *NodeAnnouncement) TimeStamp() time.Time {
+	return n.ts
+}
 
-		if m.chanFlags == 1 {
-			msg.Node = node2
-		}
+func (n *NodeAnnouncement) ID() string {
+	return n.Node
+}
 
-		bucket := int(msg.ts.Sub(startTime).Seconds() / 90)
-		if bucket >= lastBucket {
-			lastBucket = bucket
-		}
-		messages[bucket] = append(messages[bucket], msg)
+func (n *NodeAnnouncement) Size() int {
+	return n.byteLen
+}
 
-		count++
-	}
+// Bits of a channel_update's channel_flags, from BOLT 7.
+const (
+	// chanFlagDirection is clear if the update comes from node_1 of the
+	// channel, and set if it comes from node_2.
+	chanFlagDirection = 1 << 0
 
-	log.Printf("Read in flood manager with: %v buckets containing"+
-		" %v messages", len(messages), count)
+	// chanFlagDisabled is set if the update disables the channel.
+	chanFlagDisabled = 1 << 1
+)
 
-	return &floodManager{
-		messages:   messages,
-		lastBucket: lastBucket,
-	}, nil
-}
+// Bits of a channel_update's message_flags, from BOLT 7.
+const (
+	// msgFlagMaxHTLC is set if the update has htlc_maximum_msat.
+	msgFlagMaxHTLC = 1 << 0
+
+	// msgFlagDontForward is set if the update should not be forwarded to
+	// other nodes.
+	msgFlagDontForward = 1 << 1
+)
 
 type ChannelUpdate struct {
 	id      int64
@@ -194,6 +232,53 @@ type ChannelUpdate struct {
 	ts      time.Time
 	chanID  string
 	byteLen int
+
+	// Direction is 0 if the update comes from node_1 of the channel and 1
+	// if it comes from node_2.
+	Direction int
+
+	// Disabled is set if the update disables the channel, and clear if it
+	// enables it.
+	Disabled bool
+
+	// HasMaxHTLC and DontForward are the message_flags of the update.
+	HasMaxHTLC  bool
+	DontForward bool
+}
+
+// setFlags sets the fields of an update from its channel_flags and
+// message_flags.
+func (c *ChannelUpdate) setFlags(chanFlags, msgFlags int) {
+	c.Direction = chanFlags & chanFlagDirection
+	c.Disabled = chanFlags&chanFlagDisabled != 0
+	c.HasMaxHTLC = msgFlags&msgFlagMaxHTLC != 0
+	c.DontForward = msgFlags&msgFlagDontForward != 0
+}
+
+// relayable returns true if a node may relay a message to its peers. Channel
+// updates that set dont_forward are sent by the node that created them to its
+// peers, who do not relay them any further.
+func relayable(self string, msg Message) bool {
+	update, ok := msg.(*ChannelUpdate)
+	return !ok || !update.DontForward || originatedBy(self, msg)
+}
+
+// flags returns the channel_flags and message_flags of an update.
+func (c *ChannelUpdate) flags() (int, int) {
+	var chanFlags, msgFlags int
+
+	chanFlags |= c.Direction & chanFlagDirection
+	if c.Disabled {
+		chanFlags |= chanFlagDisabled
+	}
+	if c.HasMaxHTLC {
+		msgFlags |= msgFlagMaxHTLC
+	}
+	if c.DontForward {
+		msgFlags |= msgFlagDontForward
+	}
+
+	return chanFlags, msgFlags
 }
 
 func (c *ChannelUpdate) UUID() int64 {
@@ -208,8 +293,19 @@ func (c *ChannelUpdate) TimeStamp() time.Time {
 	return c.ts
 }
 
+// ID identifies an update by its channel and direction, since each of the
+// channel's nodes keeps its own policy which newer updates from it replace.
 func (c *ChannelUpdate) ID() string {
-	return c.chanID
+	return fmt.Sprintf("%v/%v", c.chanID, c.Direction)
+}
+
+func (c *ChannelUpdate) Size() int {
+	return c.byteLen
+}
+
+// StartTime returns the time that the first bucket starts at.
+func (f *floodManager) StartTime() time.Time {
+	return f.start
 }
 
 func (f *floodManager) GetNewMessages(tick int) ([]Message, bool) {
@@ -225,3 +321,7 @@ func (f *floodManager) GetNewMessages(tick int) ([]Message, bool) {
 func ReportMessage(dbc *labelledDB, msg Message, nodeID string, tick int) error {
 	return WriteMessageSeen(dbc, msg.UUID(), nodeID, tick)
 }
+
+func ReportDropped(dbc *labelledDB, msg Message, nodeID string, tick int, reason string) error {
+	return WriteMessageDropped(dbc, msg.UUID(), nodeID, tick, reason)
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// This file contains a pure Go implementation of PinSketch, the BCH based set
+// sketch used by minisketch. A sketch with capacity c over elements of
+// GF(2^32) holds the odd power sums s1, s3, ..., s(2c-1) of its elements.
+// Sketches are combined with xor, which leaves the power sums of the
+// symmetric difference of the two sets, and up to c differences can be
+// recovered by finding the roots of the set's locator polynomial.
+
+// fieldModulus is the low part of the irreducible polynomial
+// x^32 + x^7 + x^3 + x^2 + 1 which defines GF(2^32).
+const fieldModulus = 0x8d
+
+// fieldBits is the number of bits in a field element.
+const fieldBits = 32
+
+var (
+	errSketchCapacity = errors.New("sketch capacity exceeded")
+	errZeroElement    = errors.New("sketch element may not be zero")
+)
+
+// gfMul multiplies two field elements.
+func gfMul(a, b uint32) uint32 {
+	var r uint32
+	for b != 0 {
+		if b&1 == 1 {
+			r ^= a
+		}
+		b >>= 1
+
+		carry := a&(1<<31) != 0
+		a <<= 1
+		if carry {
+			a ^= fieldModulus
+		}
+	}
+
+	return r
+}
+
+// gfInv returns the multiplicative inverse of a non-zero field element, which
+// is a^(2^32-2).
+func gfInv(a uint32) uint32 {
+	result := uint32(1)
+	for i := 1; i < fieldBits; i++ {
+		a = gfMul(a, a)
+		result = gfMul(result, a)
+	}
+
+	return result
+}
+
+// Sketch is a PinSketch of a set of non-zero 32 bit elements.
+type Sketch struct {
+	// syndromes holds the odd power sums of the elements in the set.
+	syndromes []uint32
+}
+
+// NewSketch returns an empty sketch which can recover up to capacity
+// differences when merged with another sketch.
+func NewSketch(capacity int) *Sketch {
+	return &Sketch{
+		syndromes: make([]uint32, capacity),
+	}
+}
+
+// Capacity returns the maximum number of differences the sketch can decode.
+func (s *Sketch) Capacity() int {
+	return len(s.syndromes)
+}
+
+// Add toggles an element in the sketch. Adding an element twice removes it.
+func (s *Sketch) Add(element uint32) error {
+	if element == 0 {
+		return errZeroElement
+	}
+
+	square := gfMul(element, element)
+	power := element
+	for i := range s.syndromes {
+		s.syndromes[i] ^= power
+		power = gfMul(power, square)
+	}
+
+	return nil
+}
+
+// Merge combines another sketch into this one, so that it represents the
+// symmetric difference of the two sets. Sketches must have the same
+// capacity.
+func (s *Sketch) Merge(other *Sketch) error {
+	if s.Capacity() != other.Capacity() {
+		return fmt.Errorf("cannot merge sketch of capacity %v with %v",
+			other.Capacity(), s.Capacity())
+	}
+
+	for i, syndrome := range other.syndromes {
+		s.syndromes[i] ^= syndrome
+	}
+
+	return nil
+}
+
+// Decode returns the elements in the set represented by the sketch. It fails
+// with errSketchCapacity if the set is larger than the sketch's capacity.
+func (s *Sketch) Decode() ([]uint32, error) {
+	// Recover the even power sums, which are the squares of the power sums
+	// of half their power.
+	sums := make([]uint32, 2*len(s.syndromes))
+	for i := range sums {
+		power := i + 1
+		if power%2 == 1 {
+			sums[i] = s.syndromes[power/2]
+		} else {
+			sums[i] = gfMul(sums[power/2-1], sums[power/2-1])
+		}
+	}
+
+	connection := berlekampMassey(sums)
+	size := len(connection) - 1
+	if size > s.Capacity() {
+		return nil, errSketchCapacity
+	}
+	if size == 0 {
+		return nil, nil
+	}
+
+	// The connection polynomial has the inverses of the elements as roots,
+	// reversing its coefficients gives the locator polynomial whose roots
+	// are the elements themselves.
+	locator := make(poly, len(connection))
+	for i, c := range connection {
+		locator[size-i] = c
+	}
+	if locator[0] == 0 {
+		return nil, errSketchCapacity
+	}
+
+	roots, ok := findRoots(locator)
+	if !ok || len(roots) != size {
+		return nil, errSketchCapacity
+	}
+
+	return roots, nil
+}
+
+// poly is a polynomial over GF(2^32), with coefficients stored from lowest
+// to highest degree. Polynomials are kept trimmed so that their highest
+// coefficient is non-zero.
+type poly []uint32
+
+func (p poly) degree() int {
+	return len(p) - 1
+}
+
+func (p poly) trim() poly {
+	for len(p) > 0 && p[len(p)-1] == 0 {
+		p = p[:len(p)-1]
+	}
+
+	return p
+}
+
+// monic scales a polynomial so that its highest coefficient is one.
+func (p poly) monic() poly {
+	inv := gfInv(p[len(p)-1])
+
+	result := make(poly, len(p))
+	for i, c := range p {
+		result[i] = gfMul(c, inv)
+	}
+
+	return result
+}
+
+// divMod returns the quotient and remainder of dividing p by a monic divisor.
+func (p poly) divMod(divisor poly) (poly, poly) {
+	rem := append(poly{}, p...)
+	if len(rem) < len(divisor) {
+		return nil, rem
+	}
+
+	quotient := make(poly, len(rem)-len(divisor)+1)
+	for i := len(rem) - 1; i >= divisor.degree(); i-- {
+		factor := rem[i]
+		if factor == 0 {
+			continue
+		}
+
+		shift := i - divisor.degree()
+		quotient[shift] = factor
+		for j, c := range divisor {
+			rem[shift+j] ^= gfMul(factor, c)
+		}
+	}
+
+	return quotient.trim(), rem.trim()
+}
+
+// mulMod returns p*q reduced by a monic modulus.
+func (p poly) mulMod(q, modulus poly) poly {
+	if len(p) == 0 || len(q) == 0 {
+		return nil
+	}
+
+	product := make(poly, len(p)+len(q)-1)
+	for i, a := range p {
+		if a == 0 {
+			continue
+		}
+		for j, b := range q {
+			product[i+j] ^= gfMul(a, b)
+		}
+	}
+
+	_, rem := product.trim().divMod(modulus)
+	return rem
+}
+
+// gcd returns the monic greatest common divisor of two polynomials.
+func (p poly) gcd(q poly) poly {
+	a, b := p.trim(), q.trim()
+	for len(b) > 0 {
+		b = b.monic()
+		_, rem := a.divMod(b)
+		a, b = b, rem
+	}
+
+	if len(a) == 0 {
+		return a
+	}
+
+	return a.monic()
+}
+
+// berlekampMassey returns the shortest connection polynomial that generates
+// the sequence of power sums.
+func berlekampMassey(sums []uint32) poly {
+	current := poly{1}
+	previous := poly{1}
+	var length, shift int
+	lastDiscrepancy := uint32(1)
+
+	for n := range sums {
+		shift++
+
+		// Compute the discrepancy between the sequence and the output of
+		// the current connection polynomial.
+		discrepancy := sums[n]
+		for i := 1; i <= length && i < len(current); i++ {
+			discrepancy ^= gfMul(current[i], sums[n-i])
+		}
+		if discrepancy == 0 {
+			continue
+		}
+
+		factor := gfMul(discrepancy, gfInv(lastDiscrepancy))
+
+		next := append(poly{}, current...)
+		for len(next) < len(previous)+shift {
+			next = append(next, 0)
+		}
+		for i, c := range previous {
+			next[i+shift] ^= gfMul(factor, c)
+		}
+
+		if 2*length <= n {
+			length = n + 1 - length
+			previous = current
+			lastDiscrepancy = discrepancy
+			shift = 0
+		}
+		current = next
+	}
+
+	current = current.trim()
+	if current.degree() != length {
+		// The sequence was generated by a polynomial with a zero constant
+		// term, which is not a valid set of elements. Pad the polynomial so
+		// that decoding reports it as undecodable.
+		for len(current) <= length {
+			current = append(current, 0)
+		}
+	}
+
+	return current
+}
+
+// findRoots returns the roots of a polynomial if it is the product of
+// distinct linear factors.
+func findRoots(p poly) ([]uint32, bool) {
+	p = p.monic()
+
+	// A polynomial splits into distinct linear factors over GF(2^32) if and
+	// only if it divides x^(2^32) - x.
+	x := poly{0, 1}
+	_, xMod := x.divMod(p)
+	power := xMod
+	for i := 0; i < fieldBits; i++ {
+		power = power.mulMod(power, p)
+	}
+	if len(power) != len(xMod) {
+		return nil, false
+	}
+	for i := range power {
+		if power[i] != xMod[i] {
+			return nil, false
+		}
+	}
+
+	var roots []uint32
+	splitRoots(p, 0, &roots)
+
+	return roots, true
+}
+
+// splitRoots finds the roots of a monic polynomial with distinct roots using
+// Berlekamp's trace algorithm. The gcd of the polynomial with Tr(beta*x)
+// separates roots which have a different trace when multiplied by beta.
+// Trying each power of two as beta is guaranteed to separate any two roots,
+// so the search is deterministic.
+func splitRoots(p poly, basis int, roots *[]uint32) {
+	switch p.degree() {
+	case 0:
+		return
+
+	case 1:
+		*roots = append(*roots, p[0])
+		return
+	}
+
+	for ; basis < fieldBits; basis++ {
+		beta := poly{0, uint32(1) << uint(basis)}
+		_, term := beta.divMod(p)
+
+		trace := append(poly{}, term...)
+		for i := 1; i < fieldBits; i++ {
+			term = term.mulMod(term, p)
+			for len(trace) < len(term) {
+				trace = append(trace, 0)
+			}
+			for j, c := range term {
+				trace[j] ^= c
+			}
+		}
+
+		factor := p.gcd(trace)
+		if factor.degree() <= 0 || factor.degree() >= p.degree() {
+			continue
+		}
+
+		quotient, _ := p.divMod(factor)
+		splitRoots(factor, basis+1, roots)
+		splitRoots(quotient.monic(), basis+1, roots)
+		return
+	}
+}
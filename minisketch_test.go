@@ -0,0 +1,105 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGFInverse(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	for i := 0; i < 100; i++ {
+		a := r.Uint32()
+		if a == 0 {
+			continue
+		}
+
+		require.Equal(t, uint32(1), gfMul(a, gfInv(a)))
+	}
+}
+
+func TestSketchDecode(t *testing.T) {
+	tests := []struct {
+		name     string
+		capacity int
+		local    []uint32
+		remote   []uint32
+		expected []uint32
+		err      error
+	}{
+		{
+			name:     "Identical sets",
+			capacity: 2,
+			local:    []uint32{1, 2, 3},
+			remote:   []uint32{1, 2, 3},
+		},
+		{
+			name:     "Difference within capacity",
+			capacity: 4,
+			local:    []uint32{1, 2, 3, 0xdeadbeef},
+			remote:   []uint32{2, 3, 0xffffffff, 77},
+			expected: []uint32{1, 77, 0xdeadbeef, 0xffffffff},
+		},
+		{
+			name:     "Difference exceeds capacity",
+			capacity: 2,
+			local:    []uint32{1, 2, 3},
+			remote:   []uint32{4},
+			err:      errSketchCapacity,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			local := NewSketch(test.capacity)
+			for _, e := range test.local {
+				require.NoError(t, local.Add(e))
+			}
+
+			remote := NewSketch(test.capacity)
+			for _, e := range test.remote {
+				require.NoError(t, remote.Add(e))
+			}
+
+			require.NoError(t, local.Merge(remote))
+
+			diff, err := local.Decode()
+			require.Equal(t, test.err, err)
+
+			sort.Slice(diff, func(i, j int) bool {
+				return diff[i] < diff[j]
+			})
+			require.Equal(t, test.expected, diff)
+		})
+	}
+}
+
+func TestSketchDecodeRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+
+	for _, size := range []int{1, 10, 50} {
+		sketch := NewSketch(size)
+
+		expected := make(map[uint32]bool)
+		for len(expected) < size {
+			e := r.Uint32()
+			if e == 0 || expected[e] {
+				continue
+			}
+
+			expected[e] = true
+			require.NoError(t, sketch.Add(e))
+		}
+
+		diff, err := sketch.Decode()
+		require.NoError(t, err)
+		require.Len(t, diff, size)
+
+		for _, e := range diff {
+			require.True(t, expected[e])
+		}
+	}
+}
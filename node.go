@@ -1,5 +1,7 @@
 package main
 
+import "sort"
+
 type Node interface {
 	// GetPubKey returns the pubkey of this node
 	GetPubkey() string
@@ -22,14 +24,29 @@ type Node interface {
 
 	// Add peer to a given node.
 	AddPeer(peer string)
+
+	// Holding returns true if the node is holding messages that it will
+	// relay in a future tick, so the simulation should not end yet.
+	Holding() bool
+
+	// GetMessages returns the most recent version of every message the
+	// node has, sorted by ID.
+	GetMessages() []Message
 }
 
 func MakeFloodNode(pubkey string, peers []string) Node {
+	return MakeStaggeredFloodNode(pubkey, peers, 1)
+}
+
+// MakeStaggeredFloodNode returns a flood node which broadcasts the messages
+// it has received every interval ticks.
+func MakeStaggeredFloodNode(pubkey string, peers []string, interval int) Node {
 	return &FloodNode{
-		Pubkey:         pubkey,
-		RelayQueue:     make(map[string][]Message),
-		Peers:          peers,
-		CachedMessages: make(map[string]cachedMessage),
+		Pubkey:            pubkey,
+		RelayQueue:        make(map[string][]Message),
+		Peers:             peers,
+		CachedMessages:    make(map[string]cachedMessage),
+		BroadcastInterval: interval,
 	}
 }
 
@@ -57,6 +74,36 @@ type FloodNode struct {
 	// ReceivedMessages maps a uuid to the list of peers who have sent us
 	// a message, so we do not resend messages to them
 	ReceivedMessages map[string][]string
+
+	// BroadcastInterval is the number of ticks that received messages are
+	// held for before they are broadcast, modelling the staggered
+	// broadcast timer used by implementations. Messages are relayed on the
+	// next tick if it is less than two.
+	BroadcastInterval int
+
+	// ticks is the number of times the queue has been progressed.
+	ticks int
+
+	// controlQueue is the queue of peer ID -> gossip query messages to send
+	// to the peer. Queries are not subject to the broadcast interval, so
+	// they are sent on the next tick.
+	controlQueue map[string][]Message
+
+	// filters holds the gossip_timestamp_filter each peer has sent us.
+	filters peerFilters
+
+	// RequireFilter indicates that we only relay messages that we did not
+	// originate to peers that have sent us a gossip_timestamp_filter, as
+	// LND does for peers that support gossip queries.
+	RequireFilter bool
+
+	// RateLimiter decides whether we accept new messages from peers, all
+	// messages are accepted if it is nil.
+	RateLimiter RateLimiter
+
+	// Dependencies checks that new messages follow the announcements that
+	// they depend on, dependencies are not checked if it is nil.
+	Dependencies *Dependencies
 }
 
 func (n *FloodNode) GetPubkey() string {
@@ -78,11 +125,58 @@ func (n *FloodNode) GetPeers() []string {
 }
 
 func (n *FloodNode) ReceiveMessage(dbc *labelledDB, msg Message, tick int, from string) error {
-	if err := ReportMessage(dbc, msg, n.Pubkey, tick); err != nil {
-		return err
+	switch m := msg.(type) {
+	case *queryChannelRange:
+		n.queueControl(from, rangeReply(n.GetMessages()))
+		return nil
+
+	case *replyChannelRange:
+		missing := missingEntries(m, n.cached)
+		if len(missing) > 0 {
+			n.queueControl(from, &queryShortChanIDs{ids: missing})
+		}
+		return nil
+
+	case *queryShortChanIDs:
+		for _, id := range m.ids {
+			if cached, ok := n.cached(id); ok {
+				n.queueControl(from, cached)
+			}
+		}
+		n.queueControl(from, &replyShortChanIDsEnd{})
+		return nil
+
+	case *replyShortChanIDsEnd:
+		return nil
+
+	case *gossipTimestampFilter:
+		n.SetPeerFilter(from, m.filter)
+		for _, backlog := range m.filter.backlog(n.GetMessages()) {
+			n.queueControl(from, backlog)
+		}
+		return nil
 	}
 
 	cached, alreadySeen := n.CachedMessages[msg.ID()]
+	isNew := !alreadySeen || cached.TimeStamp().Before(msg.TimeStamp())
+
+	// new messages must follow their dependencies and pass our rate limit
+	// before we accept them
+	if isNew {
+		ok, err := n.Dependencies.check(dbc, msg, n.Pubkey, tick, from)
+		if err != nil || !ok {
+			return err
+		}
+
+		ok, err = admit(dbc, n.RateLimiter, msg, n.Pubkey, tick, from)
+		if err != nil || !ok {
+			return err
+		}
+	}
+
+	if err := ReportMessage(dbc, msg, n.Pubkey, tick); err != nil {
+		return err
+	}
 
 	//log.Printf("Node %v receiving message %v from %v",
 	//	n.Pubkey, msg.UUID(), from)
@@ -90,26 +184,179 @@ func (n *FloodNode) ReceiveMessage(dbc *labelledDB, msg Message, tick int, from
 	// if we have never seen a message with this ID before,
 	// or the message we stored is out of date, add to queue of things
 	// to be sent
-	if !alreadySeen || cached.TimeStamp().Before(msg.TimeStamp()) {
+	if isNew {
 		n.ReceiveQueue = append(n.ReceiveQueue, msg)
 	}
 
+	// only replace our cached copy of a message with a newer version
+	stored := msg
+	if !isNew {
+		stored = cached.Message
+	}
+
 	n.CachedMessages[msg.ID()] = cachedMessage{
-		Message:      msg,
+		Message:      stored,
 		receivedFrom: append(cached.receivedFrom, from),
 	}
 
+	if !isNew {
+		return nil
+	}
+
+	// process any messages that were waiting on this one
+	for _, deferred := range n.Dependencies.learn(msg) {
+		err := n.ReceiveMessage(dbc, deferred.msg, tick, deferred.from)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
+// QueryPeer queues a query_channel_range for a peer, which starts a sync of
+// the messages that the peer has and we do not.
+func (n *FloodNode) QueryPeer(peer string) {
+	n.queueControl(peer, &queryChannelRange{})
+}
+
+// SendTimestampFilter queues a gossip_timestamp_filter for a peer.
+func (n *FloodNode) SendTimestampFilter(peer string, filter TimestampFilter) {
+	n.queueControl(peer, &gossipTimestampFilter{filter: filter})
+}
+
+// SetPeerFilter sets the filter we apply to messages we relay to a peer.
+func (n *FloodNode) SetPeerFilter(peer string, filter TimestampFilter) {
+	if n.filters == nil {
+		n.filters = make(peerFilters)
+	}
+
+	n.filters[peer] = filter
+}
+
+// PeerDisconnected forgets the timestamp filter a peer sent us and the gossip
+// queries we queued for it, since both only last as long as the connection.
+// Gossip in our relay queue is left to be dropped, so that it is recorded as
+// missed by the peer.
+func (n *FloodNode) PeerDisconnected(peer string) {
+	delete(n.filters, peer)
+	delete(n.controlQueue, peer)
+
+	var relay []Message
+	for _, msg := range n.RelayQueue[peer] {
+		if isGossip(msg) {
+			relay = append(relay, msg)
+		}
+	}
+
+	if len(relay) == 0 {
+		delete(n.RelayQueue, peer)
+		return
+	}
+	n.RelayQueue[peer] = relay
+}
+
+// PeerConnected does nothing, peers send us a new filter if they want one
+// once they have reconnected.
+func (n *FloodNode) PeerConnected(peer string) {}
+
+// SetRateLimiter sets the limiter used for new messages from peers.
+func (n *FloodNode) SetRateLimiter(limiter RateLimiter) {
+	n.RateLimiter = limiter
+}
+
+// SetDependencies sets the tracker used to check the dependencies of new
+// messages from peers.
+func (n *FloodNode) SetDependencies(deps *Dependencies) {
+	n.Dependencies = deps
+}
+
+// GetDependencies returns the node's dependency tracker.
+func (n *FloodNode) GetDependencies() *Dependencies {
+	return n.Dependencies
+}
+
+// queueControl queues a gossip query message to be sent to a peer.
+func (n *FloodNode) queueControl(peer string, msg Message) {
+	if n.controlQueue == nil {
+		n.controlQueue = make(map[string][]Message)
+	}
+
+	n.controlQueue[peer] = append(n.controlQueue[peer], msg)
+}
+
+// cached returns the message we have cached for an ID.
+func (n *FloodNode) cached(id string) (Message, bool) {
+	cached, ok := n.CachedMessages[id]
+	if !ok {
+		return nil, false
+	}
+
+	return cached.Message, true
+}
+
+func (n *FloodNode) GetMessages() []Message {
+	messages := make([]Message, 0, len(n.CachedMessages))
+	for _, cached := range n.CachedMessages {
+		messages = append(messages, cached.Message)
+	}
+	sortByID(messages)
+
+	return messages
+}
+
+// sortByID sorts messages by their protocol ID, so that nodes list the
+// messages they have in the same order in every run.
+func sortByID(messages []Message) {
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].ID() < messages[j].ID()
+	})
+}
+
+func (n *FloodNode) Holding() bool {
+	return len(n.ReceiveQueue) > 0
+}
+
+// NextTimer returns the number of ticks until our broadcast timer next fires,
+// if we have messages waiting for it.
+func (n *FloodNode) NextTimer() (int, bool) {
+	if n.BroadcastInterval <= 1 || len(n.ReceiveQueue) == 0 {
+		return 0, false
+	}
+
+	return n.BroadcastInterval - n.ticks%n.BroadcastInterval, true
+}
+
+// SkipTicks advances our broadcast timer by ticks in which we were not
+// progressed.
+func (n *FloodNode) SkipTicks(ticks int) {
+	n.ticks += ticks
+}
+
 func (n *FloodNode) GetQueue() map[string][]Message {
 	return n.RelayQueue
 }
 
+// ProgressQueue builds the relay queue from the messages that have been
+// received since the last broadcast. If the node has a broadcast interval,
+// received messages are held until the interval has passed and nothing is
+// relayed in the meantime.
 func (n *FloodNode) ProgressQueue() {
-	relay := make(map[string][]Message)
+	n.ticks++
 
-	for _, m := range n.ReceiveQueue {
+	// gossip queries and replies are always sent on the next tick
+	relay := n.controlQueue
+	if relay == nil {
+		relay = make(map[string][]Message)
+	}
+	n.controlQueue = nil
+
+	if n.BroadcastInterval > 1 && n.ticks%n.BroadcastInterval != 0 {
+		n.RelayQueue = relay
+		return
+	}
+
+	for _, m := range dedupeQueue(n.ReceiveQueue) {
 		// get the message and the list of peers we have previously received
 		// it from
 		cached, ok := n.CachedMessages[m.ID()]
@@ -138,6 +385,17 @@ func (n *FloodNode) ProgressQueue() {
 				continue
 			}
 
+			// do not relay messages outside of the peer's timestamp
+			// filter
+			if !n.filters.allows(n.Pubkey, to, m) {
+				continue
+			}
+
+			if _, ok := n.filters[to]; n.RequireFilter && !ok &&
+				!originatedBy(n.Pubkey, m) {
+				continue
+			}
+
 			// add the message to the relay queue for the peer we have not
 			// received it from.
 			relay[to] = append(relay[to], m)
@@ -150,3 +408,28 @@ func (n *FloodNode) ProgressQueue() {
 	// clear receive queue because we have moved these to our broadcast queue
 	n.ReceiveQueue = []Message{}
 }
+
+// dedupeQueue returns a queue which contains only the newest version of each
+// message in the queue provided, in the order the messages were first queued.
+func dedupeQueue(queue []Message) []Message {
+	newest := make(map[string]Message)
+	var order []string
+
+	for _, m := range queue {
+		current, ok := newest[m.ID()]
+		if !ok {
+			order = append(order, m.ID())
+		}
+
+		if !ok || current.TimeStamp().Before(m.TimeStamp()) {
+			newest[m.ID()] = m
+		}
+	}
+
+	deduped := make([]Message, 0, len(order))
+	for _, id := range order {
+		deduped = append(deduped, newest[id])
+	}
+
+	return deduped
+}
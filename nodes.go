@@ -3,8 +3,10 @@ package main
 import (
 	"encoding/json"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"time"
 
 	"github.com/lightningnetwork/lnd/lnrpc"
 )
@@ -13,8 +15,154 @@ var (
 	chanGraphPath = flag.String("chan_graph",
 		"/Users/carla/personal/src/github.com/carlaKC/lngossip/data/July10/graph.txt",
 		"Path to channel graph obtained from LND's describe graph call")
+
+	protocol = flag.String("protocol", "flood",
+		"relay protocol to simulate: flood, inv, recon, hybrid, syncer "+
+			"or epidemic")
+
+	reconInterval = flag.Duration("recon_interval", 90*time.Second,
+		"time between set reconciliation rounds")
+
+	reconQ = flag.Float64("recon_q", 0.25,
+		"coefficient used to estimate set differences for sketch capacity")
+
+	floodFanout = flag.Int("flood_fanout", 8,
+		"number of peers hybrid nodes flood messages to")
+
+	broadcastInterval = flag.Duration("broadcast_interval", 90*time.Second,
+		"time flood nodes hold messages for before broadcasting them")
+
+	filterActivePeers = flag.Int("filter_active_peers", -1,
+		"number of peers each node asks for all gossip with "+
+			"gossip_timestamp_filter, gossip is turned off for the rest "+
+			"(-1 disables filters)")
+
+	activeSyncers = flag.Int("active_syncers", 3,
+		"number of peers syncer nodes receive live gossip from")
+
+	rotationInterval = flag.Duration("rotation_interval", 20*time.Minute,
+		"time between rotations of active syncers, at least 4 ticks "+
+			"(0 disables rotations)")
+
+	idRate = flag.Float64("id_rate_limit", 0,
+		"number of new messages per hour nodes accept for each channel "+
+			"or node ID (0 disables the limit)")
+
+	idBurst = flag.Float64("id_rate_burst", 10,
+		"number of new messages nodes accept at once for each channel or "+
+			"node ID")
+
+	originRate = flag.Float64("origin_rate_limit", 0,
+		"number of new messages per hour nodes accept from each origin "+
+			"node (0 disables the limit)")
+
+	originBurst = flag.Float64("origin_rate_burst", 10,
+		"number of new messages nodes accept at once from each origin node")
+
+	epidemicFanout = flag.Int("epidemic_fanout", 3,
+		"number of random peers epidemic nodes push new messages to")
+
+	pullRate = flag.Float64("pull_rate", 4,
+		"number of pull rounds per hour that an epidemic node starts")
+
+	dependencyMode = flag.String("dependency_mode", "off",
+		"how nodes handle channel updates and node announcements that "+
+			"arrive before their channel announcement: off, defer or "+
+			"reject")
 )
 
+// nodeMaker returns a function which creates nodes that relay messages using
+// the protocol provided. If rate limits are configured, each node is given
+// its own rate limiter.
+func nodeMaker(protocol string) (func(pubkey string, peers []string) Node, error) {
+	makeNode, err := protocolMaker(protocol)
+	if err != nil {
+		return nil, err
+	}
+
+	if *idRate == 0 && *originRate == 0 {
+		return makeNode, nil
+	}
+
+	perID := TokenBucketConfig{
+		Rate:  hourlyPerTick(*idRate),
+		Burst: *idBurst,
+	}
+	perNode := TokenBucketConfig{
+		Rate:  hourlyPerTick(*originRate),
+		Burst: *originBurst,
+	}
+
+	return func(pubkey string, peers []string) Node {
+		node := makeNode(pubkey, peers)
+
+		limited, ok := node.(RateLimited)
+		if !ok {
+			log.Printf("Node: %v cannot be rate limited", pubkey)
+			return node
+		}
+		limited.SetRateLimiter(NewTokenBucketLimiter(perID, perNode))
+
+		return node
+	}, nil
+}
+
+// protocolMaker returns a function which creates nodes that relay messages
+// using the protocol provided.
+func protocolMaker(protocol string) (func(pubkey string, peers []string) Node, error) {
+	switch protocol {
+	case "flood":
+		interval := durationTicks(*broadcastInterval)
+		return func(pubkey string, peers []string) Node {
+			return MakeStaggeredFloodNode(pubkey, peers, interval)
+		}, nil
+
+	case "inv":
+		return MakeInvNode, nil
+
+	case "recon":
+		capacity := ErlayCapacity(*reconQ)
+		interval := durationTicks(*reconInterval)
+		return func(pubkey string, peers []string) Node {
+			return MakeReconNode(pubkey, peers, interval, capacity)
+		}, nil
+
+	case "hybrid":
+		capacity := ErlayCapacity(*reconQ)
+		interval := durationTicks(*reconInterval)
+		return func(pubkey string, peers []string) Node {
+			return MakeHybridNode(pubkey, peers, *floodFanout,
+				interval, capacity)
+		}, nil
+
+	case "syncer":
+		interval := durationTicks(*rotationInterval)
+		if interval != 0 && interval < minRotationInterval {
+			return nil, fmt.Errorf("rotation interval must be 0 or at "+
+				"least %v ticks for syncs to complete, got: %v (%v "+
+				"ticks)", minRotationInterval, *rotationInterval,
+				interval)
+		}
+
+		return func(pubkey string, peers []string) Node {
+			return MakeSyncerNode(pubkey, peers, *activeSyncers,
+				interval)
+		}, nil
+
+	case "epidemic":
+		// nodes start at most one pull round a tick, so the rate
+		// becomes the probability of starting one
+		pull := hourlyPerTick(*pullRate)
+		return func(pubkey string, peers []string) Node {
+			return MakeEpidemicNode(pubkey, peers, *epidemicFanout,
+				pull, *seed)
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown protocol: %v", protocol)
+	}
+}
+
 type chanGraph struct {
 	/// The list of `LightningNode`s in this channel graph
 	Nodes []*lnrpc.LightningNode `protobuf:"bytes,1,rep,name=nodes,proto3" json:"nodes,omitempty"`
@@ -31,33 +179,86 @@ type ChannelEdge struct {
 	Capacity   int64  `protobuf:"varint,6,opt,name=capacity,proto3" json:"capacity,omitempty,string"`
 }
 
-func readChanGraph() (map[string]Node, error) {
+// readChanGraph reads in the channel graph, creating a node for each node in
+// the graph. It also returns the set of channels in the graph, which all
+// nodes are assumed to have the announcements for, along with the address
+// type of each node.
+func readChanGraph(makeNode func(pubkey string, peers []string) Node) (
+	map[string]Node, *GraphChannels, error) {
+
 	file, err := ioutil.ReadFile(*chanGraphPath)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	var graph chanGraph
 	if err := json.Unmarshal(file, &graph); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
+	channels := NewGraphChannels()
+	addressTypes := make(map[AddressType]int)
+
 	nodes := make(map[string]Node)
 	for _, node := range graph.Nodes {
-		nodes[node.PubKey] = &FloodNode{
-			Pubkey:         node.PubKey,
-			RelayQueue:     make(map[string][]Message),
-			CachedMessages: make(map[string]cachedMessage),
+		nodes[node.PubKey] = makeNode(node.PubKey, nil)
+
+		addresses := make([]string, 0, len(node.Addresses))
+		for _, addr := range node.Addresses {
+			addresses = append(addresses, addr.Addr)
 		}
+		channels.SetAddresses(node.PubKey, addresses)
+		addressTypes[channels.AddressType(node.PubKey)]++
 	}
 
 	for _, edge := range graph.Edges {
 		nodes[edge.Node1Pub].AddPeer(edge.Node2Pub)
 		nodes[edge.Node2Pub].AddPeer(edge.Node1Pub)
+
+		channels.AddChannel(edge.ChannelId, edge.Node1Pub, edge.Node2Pub)
 	}
 
 	log.Printf("Read in channel graph with %v nodes and %v edges",
 		len(graph.Nodes), len(graph.Edges))
 
-	return nodes, nil
+	log.Printf("Node addresses: %v clearnet, %v onion, %v mixed, %v unknown",
+		addressTypes[AddressClearnet], addressTypes[AddressOnion],
+		addressTypes[AddressMixed], addressTypes[AddressUnknown])
+
+	return nodes, channels, nil
+}
+
+// applyDependencies gives each node a dependency tracker that starts out
+// knowing about the channels in the graph.
+func applyDependencies(nodes map[string]Node, mode DependencyMode,
+	channels *GraphChannels) {
+
+	for pubkey, node := range nodes {
+		validated, ok := node.(DependencyValidated)
+		if !ok {
+			log.Printf("Node: %v cannot check dependencies", pubkey)
+			continue
+		}
+
+		validated.SetDependencies(NewDependencies(mode, channels))
+	}
+}
+
+// dependencyTotals returns the number of messages that nodes rejected,
+// deferred and are still holding back for missing dependencies.
+func dependencyTotals(nodes map[string]Node) (int, int, int) {
+	var rejected, deferred, pending int
+	for _, node := range nodes {
+		validated, ok := node.(DependencyValidated)
+		if !ok || validated.GetDependencies() == nil {
+			continue
+		}
+
+		deps := validated.GetDependencies()
+		rejected += deps.Rejected
+		deferred += deps.Deferred
+		pending += deps.Pending()
+	}
+
+	return rejected, deferred, pending
 }
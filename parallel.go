@@ -0,0 +1,214 @@
+package main
+
+import (
+	"flag"
+	"sort"
+	"sync"
+)
+
+var workers = flag.Int("workers", 1,
+	"number of goroutines that nodes receive and progress messages on in "+
+		"each tick, results are the same for any number of workers")
+
+// parallel calls fn for every index from zero to n, spread across the
+// number of workers provided. Calls are made in order if there is only one
+// worker. Each call must only touch state that belongs to its index.
+func parallel(workers, n int, fn func(i int)) {
+	if workers <= 1 || n <= 1 {
+		for i := 0; i < n; i++ {
+			fn(i)
+		}
+		return
+	}
+
+	indexes := make(chan int)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := range indexes {
+				fn(i)
+			}
+		}()
+	}
+
+	for i := 0; i < n; i++ {
+		indexes <- i
+	}
+	close(indexes)
+
+	wg.Wait()
+}
+
+// deliverAll has each node receive the messages sent to it, in the order
+// that they were sent. Nodes only change their own state when they receive
+// a message, so receivers are spread across workers. Each receiver records
+// its metrics in its own buffer, and the buffers are written in receiver
+// order once every receiver is done, so the DB ends up the same regardless
+// of how the receivers were scheduled.
+func deliverAll(dbc *labelledDB, nodes map[string]Node, workers, tick int,
+	deliveries map[string][]*delivery) error {
+
+	receivers := make([]string, 0, len(deliveries))
+	for receiver := range deliveries {
+		receivers = append(receivers, receiver)
+	}
+	sort.Strings(receivers)
+
+	receive := func(dbc *labelledDB, receiver string) error {
+		node := nodes[receiver]
+		for _, d := range deliveries[receiver] {
+			err := node.ReceiveMessage(dbc, d.msg, tick, d.from)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	if workers <= 1 {
+		for _, receiver := range receivers {
+			if err := receive(dbc, receiver); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	buffers := make([]*labelledDB, len(receivers))
+	errs := make([]error, len(receivers))
+
+	parallel(workers, len(receivers), func(i int) {
+		buffers[i] = dbc.buffered()
+		errs[i] = receive(buffers[i], receivers[i])
+	})
+
+	for i := range receivers {
+		if errs[i] != nil {
+			return errs[i]
+		}
+
+		if err := buffers[i].writes.flush(dbc); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// progressAll progresses the queue of every node, spread across workers,
+// and returns true if any node has messages queued or held for later.
+func progressAll(nodes map[string]Node, pubkeys []string, workers int) bool {
+	holding := make([]bool, len(pubkeys))
+
+	parallel(workers, len(pubkeys), func(i int) {
+		n := nodes[pubkeys[i]]
+		n.ProgressQueue()
+
+		holding[i] = len(n.GetQueue()) > 0 || n.Holding()
+	})
+
+	for _, h := range holding {
+		if h {
+			return true
+		}
+	}
+
+	return false
+}
+
+// seenKey identifies a node's record of a message.
+type seenKey struct {
+	uuid   int64
+	nodeID string
+}
+
+// seenWrite is the sightings of a message by a node that have been buffered.
+type seenWrite struct {
+	seenKey
+	firstSeen int
+	lastSeen  int
+	count     int
+}
+
+// droppedWrite is a buffered record of a node dropping a message.
+type droppedWrite struct {
+	uuid   int64
+	nodeID string
+	tick   int
+	reason string
+}
+
+// writeBuffer holds the messages seen and dropped by nodes until they are
+// flushed to the DB. Repeat sightings of a message by a node are combined
+// into a single write.
+type writeBuffer struct {
+	seen      []*seenWrite
+	seenIndex map[seenKey]*seenWrite
+	dropped   []droppedWrite
+}
+
+func newWriteBuffer() *writeBuffer {
+	return &writeBuffer{
+		seenIndex: make(map[seenKey]*seenWrite),
+	}
+}
+
+func (w *writeBuffer) messageSeen(uuid int64, nodeID string, tick int) {
+	key := seenKey{uuid: uuid, nodeID: nodeID}
+
+	seen, ok := w.seenIndex[key]
+	if !ok {
+		seen = &seenWrite{
+			seenKey:   key,
+			firstSeen: tick,
+		}
+		w.seenIndex[key] = seen
+		w.seen = append(w.seen, seen)
+	}
+
+	seen.lastSeen = tick
+	seen.count++
+}
+
+func (w *writeBuffer) messageDropped(uuid int64, nodeID string, tick int,
+	reason string) {
+
+	w.dropped = append(w.dropped, droppedWrite{
+		uuid:   uuid,
+		nodeID: nodeID,
+		tick:   tick,
+		reason: reason,
+	})
+}
+
+// flush writes the buffered records to a DB which is not buffered, in the
+// order they were first recorded, and empties the buffer.
+func (w *writeBuffer) flush(dbc *labelledDB) error {
+	for _, seen := range w.seen {
+		err := writeMessageSeen(dbc, seen.uuid, seen.nodeID,
+			seen.firstSeen, seen.lastSeen, seen.count)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, dropped := range w.dropped {
+		err := WriteMessageDropped(dbc, dropped.uuid, dropped.nodeID,
+			dropped.tick, dropped.reason)
+		if err != nil {
+			return err
+		}
+	}
+
+	w.seen = nil
+	w.seenIndex = make(map[seenKey]*seenWrite)
+	w.dropped = nil
+
+	return nil
+}
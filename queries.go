@@ -0,0 +1,113 @@
+package main
+
+import "time"
+
+// Querier is implemented by nodes that support gossip queries, which let a
+// node pull the messages that it is missing from a peer rather than waiting
+// for them to be pushed.
+type Querier interface {
+	// QueryPeer starts a sync with a peer by sending it a
+	// query_channel_range. The node then requests the messages that it is
+	// missing with query_short_channel_ids.
+	QueryPeer(peer string)
+}
+
+// Wire sizes of gossip query messages from BOLT 7, which all start with a 2
+// byte type and a 32 byte chain hash.
+const (
+	queryChannelRangeSize     = 2 + 32 + 4 + 4
+	replyChannelRangeSize     = 2 + 32 + 4 + 4 + 1 + 2 + 1
+	queryShortChanIDsSize     = 2 + 32 + 2 + 1
+	replyShortChanIDsEndSize  = 2 + 32 + 1
+	gossipTimestampFilterSize = 2 + 32 + 4 + 4
+
+	// rangeEntrySize is the size of a short channel ID and the timestamp
+	// listed for it in a reply_channel_range.
+	rangeEntrySize = 8 + 4
+
+	// shortChanIDSize is the size of a short channel ID.
+	shortChanIDSize = 8
+)
+
+// queryChannelRange asks a peer for the IDs and timestamps of the messages it
+// has. The simulation does not track block heights, so a query always covers
+// the full range of channels.
+type queryChannelRange struct {
+	controlMessage
+}
+
+func (q *queryChannelRange) Size() int {
+	return queryChannelRangeSize
+}
+
+// rangeEntry is the ID and timestamp of a message in a reply_channel_range.
+type rangeEntry struct {
+	id string
+	ts time.Time
+}
+
+// replyChannelRange lists the IDs and timestamps of the messages a node has
+// in response to a query_channel_range.
+type replyChannelRange struct {
+	controlMessage
+	entries []rangeEntry
+}
+
+func (r *replyChannelRange) Size() int {
+	return replyChannelRangeSize + rangeEntrySize*len(r.entries)
+}
+
+// queryShortChanIDs requests the full messages for a set of IDs.
+type queryShortChanIDs struct {
+	controlMessage
+	ids []string
+}
+
+func (q *queryShortChanIDs) Size() int {
+	return queryShortChanIDsSize + shortChanIDSize*len(q.ids)
+}
+
+// replyShortChanIDsEnd is sent after the messages requested by a
+// query_short_channel_ids.
+type replyShortChanIDsEnd struct {
+	controlMessage
+}
+
+func (r *replyShortChanIDsEnd) Size() int {
+	return replyShortChanIDsEndSize
+}
+
+// rangeReply returns a reply to a query_channel_range which lists the
+// messages provided.
+func rangeReply(messages []Message) *replyChannelRange {
+	reply := &replyChannelRange{
+		entries: make([]rangeEntry, 0, len(messages)),
+	}
+
+	for _, msg := range messages {
+		reply.entries = append(reply.entries, rangeEntry{
+			id: msg.ID(),
+			ts: msg.TimeStamp(),
+		})
+	}
+
+	return reply
+}
+
+// missingEntries returns the IDs in a reply_channel_range that lookup does
+// not have a message for, or only has an older version of.
+func missingEntries(reply *replyChannelRange,
+	lookup func(id string) (Message, bool)) []string {
+
+	var missing []string
+	for _, entry := range reply.entries {
+		cached, ok := lookup(entry.id)
+		if ok && !cached.TimeStamp().Before(entry.ts) {
+			continue
+		}
+
+		missing = append(missing, entry.id)
+	}
+
+	return missing
+}
@@ -0,0 +1,137 @@
+package main
+
+// RateLimiter decides whether a node accepts a new message from a peer.
+type RateLimiter interface {
+	// Allow returns true if a message received at tick should be accepted.
+	// Messages that are allowed count towards future limits.
+	Allow(msg Message, tick int) bool
+}
+
+// RateLimited is implemented by nodes that can rate limit the messages they
+// receive.
+type RateLimited interface {
+	// SetRateLimiter sets the limiter used to decide whether to accept new
+	// messages from peers.
+	SetRateLimiter(limiter RateLimiter)
+}
+
+// dropReasonRateLimit is recorded for messages dropped by a rate limiter.
+const dropReasonRateLimit = "rate_limit"
+
+// TokenBucketConfig configures a token bucket. Buckets start full, each
+// accepted message uses a token and tokens are added at Rate per tick up to
+// Burst. A zero Rate disables the bucket.
+type TokenBucketConfig struct {
+	Rate  float64
+	Burst float64
+}
+
+// tokenBucket is the state of a single bucket.
+type tokenBucket struct {
+	tokens   float64
+	lastTick int
+}
+
+// take refills the bucket for the ticks that have passed since it was last
+// used and takes a token from it if one is available.
+func (b *tokenBucket) take(cfg TokenBucketConfig, tick int) bool {
+	b.tokens += cfg.Rate * float64(tick-b.lastTick)
+	if b.tokens > cfg.Burst {
+		b.tokens = cfg.Burst
+	}
+	b.lastTick = tick
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// NewTokenBucketLimiter returns a rate limiter with a token bucket for each
+// message ID (the short channel ID for channel updates) and for each origin
+// node.
+func NewTokenBucketLimiter(perID, perNode TokenBucketConfig) *TokenBucketLimiter {
+	return &TokenBucketLimiter{
+		PerID:   perID,
+		PerNode: perNode,
+		ids:     make(map[string]*tokenBucket),
+		nodes:   make(map[string]*tokenBucket),
+	}
+}
+
+// TokenBucketLimiter limits the rate at which messages are accepted for each
+// message ID and from each origin node. A message is only accepted if every
+// bucket that applies to it has a token available.
+type TokenBucketLimiter struct {
+	PerID   TokenBucketConfig
+	PerNode TokenBucketConfig
+
+	ids   map[string]*tokenBucket
+	nodes map[string]*tokenBucket
+}
+
+// Allow returns true if the buckets for the message's ID and origin nodes all
+// have tokens available, and takes a token from each of them if so.
+func (t *TokenBucketLimiter) Allow(msg Message, tick int) bool {
+	var buckets []*tokenBucket
+	var configs []TokenBucketConfig
+
+	if t.PerID.Rate > 0 {
+		buckets = append(buckets, getBucket(t.ids, msg.ID(), t.PerID, tick))
+		configs = append(configs, t.PerID)
+	}
+
+	if t.PerNode.Rate > 0 {
+		for _, node := range msg.OriginNodes() {
+			buckets = append(buckets, getBucket(t.nodes, node, t.PerNode, tick))
+			configs = append(configs, t.PerNode)
+		}
+	}
+
+	// check that all buckets have capacity before taking any tokens, so
+	// that a dropped message does not count towards any limit
+	for i, b := range buckets {
+		probe := *b
+		if !probe.take(configs[i], tick) {
+			return false
+		}
+	}
+
+	for i, b := range buckets {
+		b.take(configs[i], tick)
+	}
+
+	return true
+}
+
+// getBucket returns the bucket for a key, creating a full bucket if there is
+// not one yet.
+func getBucket(buckets map[string]*tokenBucket, key string,
+	cfg TokenBucketConfig, tick int) *tokenBucket {
+
+	b, ok := buckets[key]
+	if !ok {
+		b = &tokenBucket{
+			tokens:   cfg.Burst,
+			lastTick: tick,
+		}
+		buckets[key] = b
+	}
+
+	return b
+}
+
+// admit checks a new message that a node received against its rate limiter,
+// recording the message as dropped if it is rejected. Messages that the node
+// originated are always accepted.
+func admit(dbc *labelledDB, limiter RateLimiter, msg Message, nodeID string,
+	tick int, from string) (bool, error) {
+
+	if limiter == nil || from == nodeID || limiter.Allow(msg, tick) {
+		return true, nil
+	}
+
+	return false, ReportDropped(dbc, msg, nodeID, tick, dropReasonRateLimit)
+}
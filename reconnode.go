@@ -0,0 +1,561 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"log"
+	"sort"
+)
+
+// Wire sizes of the reconciliation messages, which have a 2 byte type
+// followed by their contents. Sketch elements and short IDs are 4 bytes.
+const (
+	reconRequestSize  = 2 + 4
+	reconSketchSize   = 2
+	reconResponseSize = 2 + 1
+	shortIDSize       = 4
+)
+
+// reconRequest starts a reconciliation round with a peer. It carries the
+// size of the initiator's reconciliation set so that the responder can pick
+// the capacity of its sketch.
+type reconRequest struct {
+	controlMessage
+	setSize int
+}
+
+func (r *reconRequest) Size() int {
+	return reconRequestSize
+}
+
+// reconSketch is the responder's sketch of its reconciliation set for the
+// initiator.
+type reconSketch struct {
+	controlMessage
+	sketch *Sketch
+}
+
+func (r *reconSketch) Size() int {
+	return reconSketchSize + shortIDSize*r.sketch.Capacity()
+}
+
+// reconResponse ends a reconciliation round. It is sent by the initiator
+// after decoding the difference between its set and the responder's sketch
+// and lists the short IDs of the messages it is missing. If the difference
+// could not be decoded, failed is set and the responder sends its whole set.
+type reconResponse struct {
+	controlMessage
+	requested []uint32
+	failed    bool
+}
+
+func (r *reconResponse) Size() int {
+	return reconResponseSize + shortIDSize*len(r.requested)
+}
+
+// CapacityEstimator picks the capacity of the sketch a responder sends for a
+// reconciliation round, based on the size of its own set and the size of the
+// initiator's set.
+type CapacityEstimator func(localSize, remoteSize int) int
+
+// ErlayCapacity returns the capacity estimate used by Erlay, which is the
+// difference in set sizes plus q times the size of the smaller set, with one
+// extra element of headroom. Sketches with too little capacity usually fail
+// to decode, but a sketch with capacity one always decodes to some element,
+// so q should be large enough to avoid underestimating small differences.
+func ErlayCapacity(q float64) CapacityEstimator {
+	return func(localSize, remoteSize int) int {
+		diff, min := localSize-remoteSize, localSize
+		if diff < 0 {
+			diff, min = -diff, remoteSize
+		}
+
+		return diff + int(q*float64(min)) + 1
+	}
+}
+
+// shortID returns the non-zero element that represents a message in sketches.
+// Different versions of the same message have different short IDs.
+func shortID(msg Message) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(msg.ID()))
+
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], uint64(msg.TimeStamp().UnixNano()))
+	h.Write(ts[:])
+
+	id := h.Sum32()
+	if id == 0 {
+		id = 1
+	}
+
+	return id
+}
+
+// MakeReconNode returns a node which relays gossip by reconciling the
+// messages it has with each of its peers every interval ticks.
+func MakeReconNode(pubkey string, peers []string, interval int,
+	capacity CapacityEstimator) *ReconNode {
+
+	return &ReconNode{
+		Pubkey:         pubkey,
+		Peers:          peers,
+		Interval:       interval,
+		Capacity:       capacity,
+		RelayQueue:     make(map[string][]Message),
+		CachedMessages: make(map[string]Message),
+		ReconSets:      make(map[string]map[uint32]Message),
+		shortIDs:       make(map[uint32]Message),
+		pending:        make(map[string][]Message),
+		initiated:      make(map[string]bool),
+		inFlight:       make(map[string]map[uint32]Message),
+		floodPeers:     make(map[string]bool),
+		disconnected:   make(map[string]bool),
+	}
+}
+
+// ReconNode relays gossip using set reconciliation. Rather than sending new
+// messages to its peers, it adds them to a per-peer reconciliation set. Every
+// Interval ticks, a node starts a reconciliation round with each peer that it
+// has messages for:
+//  1. The initiator sends a reconRequest with the size of its set.
+//  2. The responder sends a sketch of its set for the initiator.
+//  3. The initiator decodes the difference between the sets, sends the
+//     messages that the responder lacks and requests the ones it lacks.
+//  4. The responder sends the requested messages.
+//
+// Messages which are in both sets cancel out, so they are never sent.
+type ReconNode struct {
+	// PubKey of the node being represented
+	Pubkey string
+
+	// Pubkeys of peers
+	Peers []string
+
+	// Interval is the number of ticks between reconciliation rounds.
+	Interval int
+
+	// Capacity picks the capacity of the sketches we send.
+	Capacity CapacityEstimator
+
+	// Queue of peer ID -> messages to send to peer this tick
+	RelayQueue map[string][]Message
+
+	// Map protocol ID to the most recent message we have for the ID
+	CachedMessages map[string]Message
+
+	// ReconSets maps a peer to the short IDs of the messages that we have
+	// not yet reconciled with the peer.
+	ReconSets map[string]map[uint32]Message
+
+	// shortIDs maps the short ID of every message we have seen to the
+	// message.
+	shortIDs map[uint32]Message
+
+	// pending is the queue of peer ID -> messages produced while receiving
+	// messages, it becomes the relay queue when the queue is progressed.
+	pending map[string][]Message
+
+	// initiated tracks the peers that we have sent a reconRequest to and
+	// not yet received a sketch from.
+	initiated map[string]bool
+
+	// inFlight holds the reconciliation set we sketched for each peer that
+	// we are responding to, until the initiator tells us what it needs.
+	inFlight map[string]map[uint32]Message
+
+	// floodPeers is the set of peers that we send new messages to directly
+	// rather than reconciling them.
+	floodPeers map[string]bool
+
+	// disconnected is the set of peers that we are not connected to, we
+	// do not reconcile or flood messages to them.
+	disconnected map[string]bool
+
+	// filters holds the gossip_timestamp_filter each peer has sent us.
+	filters peerFilters
+
+	// RateLimiter decides whether we accept new messages from peers, all
+	// messages are accepted if it is nil.
+	RateLimiter RateLimiter
+
+	// Dependencies checks that new messages follow the announcements that
+	// they depend on, dependencies are not checked if it is nil.
+	Dependencies *Dependencies
+
+	// ticks is the number of times the queue has been progressed.
+	ticks int
+}
+
+func (n *ReconNode) GetPubkey() string {
+	return n.Pubkey
+}
+
+func (n *ReconNode) AddPeer(peer string) {
+	// do not add duplicate peers
+	for _, p := range n.Peers {
+		if p == peer {
+			return
+		}
+	}
+	n.Peers = append(n.Peers, peer)
+}
+
+func (n *ReconNode) GetPeers() []string {
+	return n.Peers
+}
+
+func (n *ReconNode) GetMessages() []Message {
+	messages := make([]Message, 0, len(n.CachedMessages))
+	for _, msg := range n.CachedMessages {
+		messages = append(messages, msg)
+	}
+	sortByID(messages)
+
+	return messages
+}
+
+// Holding returns true if we have messages that have not been reconciled with
+// a peer yet.
+func (n *ReconNode) Holding() bool {
+	for _, set := range n.ReconSets {
+		if len(set) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// NextTimer returns the number of ticks until our next reconciliation rounds,
+// if we have messages to reconcile.
+func (n *ReconNode) NextTimer() (int, bool) {
+	if n.Interval <= 1 || !n.Holding() {
+		return 0, false
+	}
+
+	return n.Interval - n.ticks%n.Interval, true
+}
+
+// SkipTicks advances our reconciliation timer by ticks in which we were not
+// progressed.
+func (n *ReconNode) SkipTicks(ticks int) {
+	n.ticks += ticks
+}
+
+func (n *ReconNode) GetQueue() map[string][]Message {
+	return n.RelayQueue
+}
+
+// ProgressQueue starts reconciliation rounds with peers if a round is due,
+// then moves the messages queued this tick into the relay queue.
+func (n *ReconNode) ProgressQueue() {
+	n.ticks++
+
+	if n.Interval <= 1 || n.ticks%n.Interval == 0 {
+		for _, peer := range n.Peers {
+			n.initiate(peer)
+		}
+	}
+
+	n.RelayQueue = n.pending
+	n.pending = make(map[string][]Message)
+}
+
+// initiate starts a reconciliation round with a peer if we have messages
+// for it and are not already reconciling with it.
+func (n *ReconNode) initiate(peer string) {
+	if len(n.ReconSets[peer]) == 0 || n.initiated[peer] ||
+		n.inFlight[peer] != nil || n.disconnected[peer] {
+		return
+	}
+
+	n.initiated[peer] = true
+	n.pending[peer] = append(n.pending[peer], &reconRequest{
+		setSize: len(n.ReconSets[peer]),
+	})
+}
+
+// ReceiveMessage handles reconciliation messages and full messages from
+// peers. Only full messages are reported in the metrics store.
+func (n *ReconNode) ReceiveMessage(dbc *labelledDB, msg Message, tick int, from string) error {
+	switch m := msg.(type) {
+	case *reconRequest:
+		n.receiveRequest(m, from)
+
+	case *reconSketch:
+		n.receiveSketch(m, from)
+
+	case *reconResponse:
+		n.receiveResponse(m, from)
+
+	case *gossipTimestampFilter:
+		n.SetPeerFilter(from, m.filter)
+
+		backlog := m.filter.backlog(n.GetMessages())
+		if len(backlog) > 0 {
+			n.pending[from] = append(n.pending[from], backlog...)
+		}
+
+	default:
+		return n.receiveFull(dbc, msg, tick, from)
+	}
+
+	return nil
+}
+
+// receiveFull caches a full message and adds it to the reconciliation sets
+// of all our peers except the sender if it is new to us. Messages are sent to
+// flood peers straight away instead.
+func (n *ReconNode) receiveFull(dbc *labelledDB, msg Message, tick int, from string) error {
+	cached, haveOlder := n.CachedMessages[msg.ID()]
+	isNew := !haveOlder || cached.TimeStamp().Before(msg.TimeStamp())
+
+	// new messages must follow their dependencies and pass our rate limit
+	// before we accept them
+	if isNew {
+		ok, err := n.Dependencies.check(dbc, msg, n.Pubkey, tick, from)
+		if err != nil || !ok {
+			return err
+		}
+
+		ok, err = admit(dbc, n.RateLimiter, msg, n.Pubkey, tick, from)
+		if err != nil || !ok {
+			return err
+		}
+	}
+
+	if err := ReportMessage(dbc, msg, n.Pubkey, tick); err != nil {
+		return err
+	}
+
+	id := shortID(msg)
+
+	// the sender already has the message, so we do not need to reconcile
+	// it with them
+	delete(n.ReconSets[from], id)
+
+	if !isNew {
+		return nil
+	}
+	n.CachedMessages[msg.ID()] = msg
+	n.shortIDs[id] = msg
+
+	for _, peer := range n.Peers {
+		// messages are not queued for peers we are disconnected from,
+		// they catch up when they reconnect
+		if n.disconnected[peer] {
+			continue
+		}
+
+		allowed := peer != from && n.filters.allows(n.Pubkey, peer, msg)
+
+		if n.floodPeers[peer] {
+			if allowed {
+				n.pending[peer] = append(n.pending[peer], msg)
+			}
+			continue
+		}
+
+		set, ok := n.ReconSets[peer]
+		if !ok {
+			set = make(map[uint32]Message)
+			n.ReconSets[peer] = set
+		}
+
+		// an outdated version of the message does not need to be
+		// reconciled anymore
+		if haveOlder {
+			delete(set, shortID(cached))
+		}
+
+		if allowed {
+			set[id] = msg
+		}
+	}
+
+	// process any messages that were waiting on this one
+	for _, deferred := range n.Dependencies.learn(msg) {
+		err := n.receiveFull(dbc, deferred.msg, tick, deferred.from)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// PeerDisconnected abandons any reconciliation round with a peer and drops
+// our reconciliation set for it, since sets only last as long as the
+// connection.
+func (n *ReconNode) PeerDisconnected(peer string) {
+	n.disconnected[peer] = true
+
+	delete(n.initiated, peer)
+	delete(n.inFlight, peer)
+	delete(n.ReconSets, peer)
+}
+
+// PeerConnected lets us reconcile with a peer again.
+func (n *ReconNode) PeerConnected(peer string) {
+	delete(n.disconnected, peer)
+}
+
+// SendTimestampFilter queues a gossip_timestamp_filter for a peer.
+func (n *ReconNode) SendTimestampFilter(peer string, filter TimestampFilter) {
+	n.pending[peer] = append(n.pending[peer], &gossipTimestampFilter{
+		filter: filter,
+	})
+}
+
+// SetPeerFilter sets the filter we apply to messages we relay to a peer.
+// Messages outside of the filter are not added to the peer's reconciliation
+// set.
+func (n *ReconNode) SetPeerFilter(peer string, filter TimestampFilter) {
+	if n.filters == nil {
+		n.filters = make(peerFilters)
+	}
+
+	n.filters[peer] = filter
+}
+
+// SetRateLimiter sets the limiter used for new messages from peers.
+func (n *ReconNode) SetRateLimiter(limiter RateLimiter) {
+	n.RateLimiter = limiter
+}
+
+// SetDependencies sets the tracker used to check the dependencies of new
+// messages from peers.
+func (n *ReconNode) SetDependencies(deps *Dependencies) {
+	n.Dependencies = deps
+}
+
+// GetDependencies returns the node's dependency tracker.
+func (n *ReconNode) GetDependencies() *Dependencies {
+	return n.Dependencies
+}
+
+// receiveRequest responds to a peer starting a reconciliation round with a
+// sketch of our set for the peer.
+func (n *ReconNode) receiveRequest(req *reconRequest, from string) {
+	// If we started a round with the peer at the same time, the node with
+	// the lower pubkey's round goes ahead.
+	if n.initiated[from] {
+		if n.Pubkey < from {
+			return
+		}
+		delete(n.initiated, from)
+	}
+
+	set := n.ReconSets[from]
+	sketch := NewSketch(n.Capacity(len(set), req.setSize))
+	for id := range set {
+		if err := sketch.Add(id); err != nil {
+			log.Printf("Could not add %v to sketch: %v", id, err)
+		}
+	}
+
+	n.inFlight[from] = set
+	delete(n.ReconSets, from)
+
+	n.pending[from] = append(n.pending[from], &reconSketch{
+		sketch: sketch,
+	})
+}
+
+// receiveSketch decodes the difference between the responder's sketch and
+// our set, sending the messages the responder lacks and requesting the ones
+// that we lack. If the sketch cannot be decoded, we send our whole set and
+// ask the responder to do the same.
+func (n *ReconNode) receiveSketch(msg *reconSketch, from string) {
+	if !n.initiated[from] {
+		return
+	}
+	delete(n.initiated, from)
+
+	set := n.ReconSets[from]
+	delete(n.ReconSets, from)
+
+	sketch := NewSketch(msg.sketch.Capacity())
+	for id := range set {
+		if err := sketch.Add(id); err != nil {
+			log.Printf("Could not add %v to sketch: %v", id, err)
+		}
+	}
+
+	if err := sketch.Merge(msg.sketch); err != nil {
+		log.Printf("Could not merge sketch from %v: %v", from, err)
+	}
+
+	diff, err := sketch.Decode()
+	if err != nil {
+		n.pending[from] = append(n.pending[from], setMessages(set)...)
+		n.pending[from] = append(n.pending[from], &reconResponse{
+			failed: true,
+		})
+
+		return
+	}
+
+	var requested []uint32
+	for _, id := range diff {
+		// if the message is in our set, the responder lacks it
+		if m, ok := set[id]; ok {
+			n.pending[from] = append(n.pending[from], m)
+			continue
+		}
+
+		// if it is not in our set, we lack it unless we received it
+		// from the responder after they sketched their set
+		if _, ok := n.shortIDs[id]; !ok {
+			requested = append(requested, id)
+		}
+	}
+
+	n.pending[from] = append(n.pending[from], &reconResponse{
+		requested: requested,
+	})
+}
+
+// receiveResponse completes a reconciliation round that we responded to by
+// sending the messages the initiator requested.
+func (n *ReconNode) receiveResponse(msg *reconResponse, from string) {
+	set := n.inFlight[from]
+	delete(n.inFlight, from)
+
+	if msg.failed {
+		n.pending[from] = append(n.pending[from], setMessages(set)...)
+		return
+	}
+
+	for _, id := range msg.requested {
+		m, ok := set[id]
+		if !ok {
+			m, ok = n.shortIDs[id]
+		}
+		if !ok {
+			continue
+		}
+
+		n.pending[from] = append(n.pending[from], m)
+	}
+}
+
+// setMessages returns the messages in a reconciliation set, sorted by short
+// ID so that they are sent in the same order in every run.
+func setMessages(set map[uint32]Message) []Message {
+	ids := make([]uint32, 0, len(set))
+	for id := range set {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+
+	messages := make([]Message, 0, len(ids))
+	for _, id := range ids {
+		messages = append(messages, set[id])
+	}
+
+	return messages
+}
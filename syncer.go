@@ -0,0 +1,231 @@
+package main
+
+// minRotationInterval is the smallest number of ticks allowed between
+// rotations of active syncers, which is the number of ticks a historical sync
+// takes: query_channel_range, reply_channel_range, query_short_channel_ids
+// and the messages that are missing.
+const minRotationInterval = 4
+
+// MakeSyncerNode returns a flood node which takes live gossip from a small set
+// of active peers, rotating one active peer every rotationInterval ticks.
+func MakeSyncerNode(pubkey string, peers []string, activeSyncers,
+	rotationInterval int) Node {
+
+	flood := MakeFloodNode(pubkey, peers).(*FloodNode)
+	flood.RequireFilter = true
+
+	return &SyncerNode{
+		FloodNode:        flood,
+		ActiveSyncers:    activeSyncers,
+		RotationInterval: rotationInterval,
+		disconnected:     make(map[string]bool),
+	}
+}
+
+// SyncerNode models LND's SyncManager. When the simulation starts, the node
+// asks its first ActiveSyncers peers for all live gossip with a
+// gossip_timestamp_filter and turns gossip off for the rest of its peers,
+// which are passive. Every RotationInterval ticks, the longest serving active
+// syncer is made passive and the next passive peer is made active. The node
+// performs a historical sync with the new active peer using gossip queries.
+// Rotations are skipped if the node has not received any new messages since
+// the last one, so that they stop once the network has settled. When an
+// active syncer disconnects, it is replaced by the next passive peer that the
+// node is connected to.
+//
+// Since SyncerNodes only relay gossip to peers that have sent them a filter,
+// they should be used alongside each other rather than with other node types.
+type SyncerNode struct {
+	*FloodNode
+
+	// ActiveSyncers is the number of peers we receive live gossip from.
+	ActiveSyncers int
+
+	// RotationInterval is the number of ticks between rotations of active
+	// syncers, rotations are disabled if it is zero.
+	RotationInterval int
+
+	// active is the list of active syncers, ordered by the time they were
+	// made active.
+	active []string
+
+	// next is the index of the peer that will next be made active.
+	next int
+
+	// ticks is the number of times the queue has been progressed.
+	ticks int
+
+	// received is set if we have received new messages since the last
+	// rotation.
+	received bool
+
+	// disconnected is the set of peers that we are not connected to, they
+	// are not made active until they reconnect.
+	disconnected map[string]bool
+}
+
+// ProgressQueue sends timestamp filters to our peers when the simulation
+// starts and when active syncers are rotated, then progresses the flood
+// node's queue.
+func (n *SyncerNode) ProgressQueue() {
+	if len(n.ReceiveQueue) > 0 {
+		n.received = true
+	}
+
+	switch {
+	case n.ticks == 0:
+		n.start()
+
+	case n.RotationInterval > 0 && n.ticks%n.RotationInterval == 0 &&
+		n.received:
+
+		n.rotate()
+		n.received = false
+	}
+	n.ticks++
+
+	n.FloodNode.ProgressQueue()
+}
+
+// NextTimer returns the number of ticks until our next rotation, if we have
+// received new messages since the last one, or until the flood node's
+// broadcast timer fires if that is sooner.
+func (n *SyncerNode) NextTimer() (int, bool) {
+	next, ok := n.FloodNode.NextTimer()
+
+	received := n.received || len(n.ReceiveQueue) > 0
+	if n.RotationInterval <= 0 || n.ticks == 0 || !received {
+		return next, ok
+	}
+
+	// rotations happen when the queue is progressed at a multiple of
+	// the interval, before the tick is counted
+	rotation := (n.RotationInterval-n.ticks%n.RotationInterval)%
+		n.RotationInterval + 1
+	if !ok || rotation < next {
+		return rotation, true
+	}
+
+	return next, true
+}
+
+// SkipTicks advances our rotation and broadcast timers by ticks in which we
+// were not progressed.
+func (n *SyncerNode) SkipTicks(ticks int) {
+	n.ticks += ticks
+	n.FloodNode.SkipTicks(ticks)
+}
+
+// start makes our first ActiveSyncers connected peers active and the rest
+// passive. Peers that we are not connected to are sent a filter when they
+// reconnect.
+func (n *SyncerNode) start() {
+	for i, peer := range n.Peers {
+		if n.disconnected[peer] {
+			continue
+		}
+
+		if len(n.active) < n.ActiveSyncers {
+			n.active = append(n.active, peer)
+			n.SendTimestampFilter(peer, AllGossip)
+			n.next = i + 1
+			continue
+		}
+
+		n.SendTimestampFilter(peer, NoGossip)
+	}
+}
+
+// rotate replaces the longest serving active syncer with the next passive
+// peer, and performs a historical sync with the new active syncer. Nothing is
+// rotated if there is no passive peer that we are connected to.
+func (n *SyncerNode) rotate() {
+	if len(n.active) == 0 {
+		return
+	}
+
+	demoted := n.active[0]
+	if !n.promote(demoted) {
+		return
+	}
+
+	n.active = n.active[1:]
+	n.SendTimestampFilter(demoted, NoGossip)
+}
+
+// promote makes the next passive peer that we are connected to, other than
+// skip, an active syncer. It returns false if there is no such peer.
+func (n *SyncerNode) promote(skip string) bool {
+	// peers may have been added since we started so we cannot rely on
+	// them being passive
+	for i := 0; i < len(n.Peers); i++ {
+		peer := n.Peers[n.next%len(n.Peers)]
+		n.next++
+
+		if peer == skip || n.isActive(peer) || n.disconnected[peer] {
+			continue
+		}
+
+		n.activate(peer)
+
+		return true
+	}
+
+	return false
+}
+
+// activate makes a peer an active syncer, and performs a historical sync
+// with it.
+func (n *SyncerNode) activate(peer string) {
+	n.active = append(n.active, peer)
+	n.SendTimestampFilter(peer, AllGossip)
+	n.QueryPeer(peer)
+}
+
+// PeerDisconnected replaces a peer with the next passive peer if it was an
+// active syncer.
+func (n *SyncerNode) PeerDisconnected(peer string) {
+	n.FloodNode.PeerDisconnected(peer)
+	n.disconnected[peer] = true
+
+	for i, p := range n.active {
+		if p != peer {
+			continue
+		}
+
+		n.active = append(n.active[:i:i], n.active[i+1:]...)
+		n.promote(peer)
+
+		return
+	}
+}
+
+// PeerConnected sends a reconnected peer our filter again, making it an
+// active syncer if we are short of them.
+func (n *SyncerNode) PeerConnected(peer string) {
+	n.FloodNode.PeerConnected(peer)
+	delete(n.disconnected, peer)
+
+	// peers are sent their filters when we start
+	if n.ticks == 0 {
+		return
+	}
+
+	if len(n.active) < n.ActiveSyncers {
+		n.activate(peer)
+		return
+	}
+
+	n.SendTimestampFilter(peer, NoGossip)
+}
+
+// isActive returns true if a peer is one of our active syncers.
+func (n *SyncerNode) isActive(peer string) bool {
+	for _, p := range n.active {
+		if p == peer {
+			return true
+		}
+	}
+
+	return false
+}
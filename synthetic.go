@@ -0,0 +1,313 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+var (
+	updateRate = flag.Float64("update_rate", 0.4,
+		"expected channel updates per channel per hour in a synthetic "+
+			"workload")
+
+	burstRate = flag.Float64("burst_rate", 2,
+		"expected number of times per hour that a random node updates "+
+			"all of its channels in a synthetic workload")
+
+	keepAliveShare = flag.Float64("keepalive_share", 0.1,
+		"share of channels that send a keep-alive update in a synthetic "+
+			"workload")
+
+	newChannelRate = flag.Float64("new_channel_rate", 4,
+		"expected channels opened per hour in a synthetic workload")
+
+	nodeAnnouncementRate = flag.Float64("node_announcement_rate", 0.04,
+		"expected node announcements per node per hour in a synthetic "+
+			"workload")
+)
+
+// Wire sizes used for generated messages, based on the BOLT 7 encodings
+// without features or addresses.
+const (
+	channelUpdateSize       = 138
+	channelAnnouncementSize = 430
+	nodeAnnouncementSize    = 142
+)
+
+// SyntheticConfig configures a generated workload. Rates are expected counts
+// per hour of real time, so that a workload has the same rates whatever the
+// tick duration.
+type SyntheticConfig struct {
+	// Ticks is the number of ticks to generate messages for.
+	Ticks int
+
+	// UpdateRate is the rate of channel updates for each channel.
+	UpdateRate float64
+
+	// BurstRate is the rate at which a random node changes the fees on
+	// all of its channels.
+	BurstRate float64
+
+	// KeepAliveShare is the share of channels that send a keep-alive
+	// update, which refreshes the channel without changing it, at a
+	// random tick in the workload.
+	KeepAliveShare float64
+
+	// NewChannelRate is the rate at which channels are opened between
+	// random nodes. New channels are announced and then updated by both
+	// of their nodes.
+	NewChannelRate float64
+
+	// NodeAnnouncementRate is the rate of node announcements for each
+	// node that has channels.
+	NodeAnnouncementRate float64
+
+	// Start is the time of the first tick, messages are timestamped by
+	// their tick.
+	Start time.Time
+
+	// TickDuration is the amount of time that each tick represents.
+	TickDuration time.Duration
+
+	// Seed seeds all random choices, so that a workload can be recreated.
+	Seed int64
+}
+
+// syntheticConfig returns the workload configuration set by flags for a
+// simulation of the duration provided.
+func syntheticConfig(start time.Time, duration,
+	tick time.Duration) SyntheticConfig {
+
+	return SyntheticConfig{
+		Ticks:                int(duration / tick),
+		UpdateRate:           *updateRate,
+		BurstRate:            *burstRate,
+		KeepAliveShare:       *keepAliveShare,
+		NewChannelRate:       *newChannelRate,
+		NodeAnnouncementRate: *nodeAnnouncementRate,
+		Start:                start,
+		TickDuration:         tick,
+		Seed:                 *seed,
+	}
+}
+
+// syntheticGenerator builds a workload for a channel graph.
+type syntheticGenerator struct {
+	cfg  SyntheticConfig
+	rand *rand.Rand
+
+	// channels and nodes are the channels and nodes in the graph in a
+	// fixed order, new channels are added as they are opened.
+	channels []string
+	nodes    []string
+	edges    map[string][2]string
+
+	// nodeChannels maps a node to the channels that it has.
+	nodeChannels map[string][]string
+
+	messages map[int][]Message
+	uuid     int64
+	opened   int
+}
+
+// NewSyntheticMessageManager returns a message manager with a generated
+// workload for the channels in graph.
+func NewSyntheticMessageManager(graph *GraphChannels,
+	cfg SyntheticConfig) MessageManager {
+
+	g := &syntheticGenerator{
+		cfg:          cfg,
+		rand:         rand.New(rand.NewSource(cfg.Seed)),
+		edges:        make(map[string][2]string),
+		nodeChannels: make(map[string][]string),
+		messages:     make(map[int][]Message),
+	}
+
+	for chanID, nodes := range graph.channels {
+		g.addChannel(chanID, nodes)
+	}
+	sort.Strings(g.channels)
+	for _, channels := range g.nodeChannels {
+		sort.Strings(channels)
+	}
+
+	for node := range graph.nodes {
+		g.nodes = append(g.nodes, node)
+	}
+	sort.Strings(g.nodes)
+
+	for tick := 0; tick < cfg.Ticks; tick++ {
+		g.generateTick(tick)
+	}
+	g.generateKeepAlives()
+
+	var count int
+	for _, messages := range g.messages {
+		count += len(messages)
+	}
+	log.Printf("Generated %v messages for %v channels over %v ticks",
+		count, len(g.channels), cfg.Ticks)
+
+	return &floodManager{
+		messages:   g.messages,
+		lastBucket: cfg.Ticks - 1,
+		start:      cfg.Start,
+	}
+}
+
+func (g *syntheticGenerator) addChannel(chanID string, nodes [2]string) {
+	g.channels = append(g.channels, chanID)
+	g.edges[chanID] = nodes
+
+	for _, node := range nodes {
+		g.nodeChannels[node] = append(g.nodeChannels[node], chanID)
+	}
+}
+
+// generateTick adds the messages for a tick. Announcements are added before
+// the updates that depend on them.
+func (g *syntheticGenerator) generateTick(tick int) {
+	for i := g.poisson(g.perTick(g.cfg.NewChannelRate)); i > 0; i-- {
+		g.openChannel(tick)
+	}
+
+	// nodes and channels send each message at most once per tick
+	for _, node := range g.nodes {
+		if len(g.nodeChannels[node]) == 0 {
+			continue
+		}
+
+		if g.poisson(g.perTick(g.cfg.NodeAnnouncementRate)) > 0 {
+			g.add(tick, &NodeAnnouncement{
+				Node:    node,
+				byteLen: nodeAnnouncementSize,
+			})
+		}
+	}
+
+	for _, chanID := range g.channels {
+		if g.poisson(g.perTick(g.cfg.UpdateRate)) > 0 {
+			g.update(tick, chanID, g.edges[chanID][g.rand.Intn(2)])
+		}
+	}
+
+	if len(g.nodes) == 0 {
+		return
+	}
+
+	for i := g.poisson(g.perTick(g.cfg.BurstRate)); i > 0; i-- {
+		node := g.nodes[g.rand.Intn(len(g.nodes))]
+		for _, chanID := range g.nodeChannels[node] {
+			g.update(tick, chanID, node)
+		}
+	}
+}
+
+// perTick converts a rate per hour into the expected count per tick.
+func (g *syntheticGenerator) perTick(rate float64) float64 {
+	return rate * g.cfg.TickDuration.Hours()
+}
+
+// generateKeepAlives adds a keep-alive update at a random tick for a share of
+// the channels that existed at the start of the workload.
+func (g *syntheticGenerator) generateKeepAlives() {
+	if g.cfg.Ticks == 0 {
+		return
+	}
+
+	for _, chanID := range g.channels[:len(g.channels)-g.opened] {
+		if g.rand.Float64() >= g.cfg.KeepAliveShare {
+			continue
+		}
+
+		tick := g.rand.Intn(g.cfg.Ticks)
+		g.update(tick, chanID, g.edges[chanID][g.rand.Intn(2)])
+	}
+}
+
+// openChannel announces a channel between two random nodes, and adds an
+// update from each of them.
+func (g *syntheticGenerator) openChannel(tick int) {
+	if len(g.nodes) < 2 {
+		return
+	}
+
+	node1 := g.nodes[g.rand.Intn(len(g.nodes))]
+	node2 := g.nodes[g.rand.Intn(len(g.nodes))]
+	if node1 == node2 {
+		return
+	}
+
+	g.opened++
+	chanID := fmt.Sprintf("synthetic-%v", g.opened)
+
+	g.add(tick, &ChannelAnnouncement{
+		Node1:   node1,
+		Node2:   node2,
+		chanID:  chanID,
+		byteLen: channelAnnouncementSize,
+	})
+	g.addChannel(chanID, [2]string{node1, node2})
+
+	g.update(tick, chanID, node1)
+	g.update(tick, chanID, node2)
+}
+
+func (g *syntheticGenerator) update(tick int, chanID, node string) {
+	update := &ChannelUpdate{
+		Node:    node,
+		chanID:  chanID,
+		byteLen: channelUpdateSize,
+	}
+	if g.edges[chanID][1] == node {
+		update.Direction = 1
+	}
+
+	g.add(tick, update)
+}
+
+// add sets a message's UUID and timestamp, and adds it to a tick. Messages
+// are spaced a microsecond apart within their tick so that later messages
+// always replace earlier ones.
+func (g *syntheticGenerator) add(tick int, msg Message) {
+	g.uuid++
+
+	ts := g.cfg.Start.Add(time.Duration(tick)*g.cfg.TickDuration +
+		time.Duration(len(g.messages[tick]))*time.Microsecond)
+
+	switch m := msg.(type) {
+	case *ChannelUpdate:
+		m.id, m.ts = g.uuid, ts
+
+	case *ChannelAnnouncement:
+		m.id, m.ts = g.uuid, ts
+
+	case *NodeAnnouncement:
+		m.id, m.ts = g.uuid, ts
+	}
+
+	g.messages[tick] = append(g.messages[tick], msg)
+}
+
+// poisson samples a Poisson distribution with the mean provided.
+func (g *syntheticGenerator) poisson(mean float64) int {
+	if mean <= 0 {
+		return 0
+	}
+
+	limit := math.Exp(-mean)
+	product := g.rand.Float64()
+
+	var count int
+	for product > limit {
+		count++
+		product *= g.rand.Float64()
+	}
+
+	return count
+}